@@ -3,15 +3,26 @@ package main
 // All stuff abount reading ca.pem
 
 import (
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/pem"
-	"errors"
 	"fmt"
+	"log"
 	"os"
+	"strings"
+	"time"
 )
 
-func get_ca_cert_pool(pCertPool *x509.CertPool) (err error) {
-	data, err := os.ReadFile(caFile)
+// defaultCertWarningWindow is used if cert_warning_window is not given in config file.
+const defaultCertWarningWindow = 30 * 24 * time.Hour
+
+// caCertificates contains the certificates read from ca.pem.
+var caCertificates []*x509.Certificate
+
+// get_ca_cert_pool adds certificates of optional file ca.pem to pCertPool.
+// Certificates expiring within warningWindow are warned about.
+func get_ca_cert_pool(pCertPool *x509.CertPool, warningWindow time.Duration) (err error) {
+	caCertificates, err = read_pem_certs(caFile)
 	if os.IsNotExist(err) {
 		err = nil
 		return
@@ -19,6 +30,36 @@ func get_ca_cert_pool(pCertPool *x509.CertPool) (err error) {
 		return
 	}
 
+	for _, pCertificate := range caCertificates {
+		warn_expiry(caFile, pCertificate, warningWindow)
+		pCertPool.AddCert(pCertificate)
+	}
+
+	return
+}
+
+// add_ca_file adds certificates given in PEM file fileName to pCertPool.
+func add_ca_file(pCertPool *x509.CertPool, fileName string) (err error) {
+	certificates, err := read_pem_certs(fileName)
+	if err != nil {
+		return
+	}
+
+	for _, pCertificate := range certificates {
+		pCertPool.AddCert(pCertificate)
+	}
+
+	return
+}
+
+// read_pem_certs reads certificates given in PEM file fileName.
+// PEM blocks which are no valid certificates are warned about and skipped.
+func read_pem_certs(fileName string) (certificates []*x509.Certificate, err error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return
+	}
+
 	for {
 		block, rest := pem.Decode(data)
 		data = rest
@@ -28,22 +69,46 @@ func get_ca_cert_pool(pCertPool *x509.CertPool) (err error) {
 
 		switch block.Type {
 		case "CERTIFICATE":
-			certificate, cerr := x509.ParseCertificate(block.Bytes)
+			pCertificate, cerr := x509.ParseCertificate(block.Bytes)
 			if cerr != nil {
-				err = errors.Join(
-					err,
-					cerr)
+				log.Printf("WARNING: %s: certificate skipped: %v", fileName, cerr)
 				continue
 			}
 
-			pCertPool.AddCert(certificate)
+			certificates = append(certificates, pCertificate)
 
 		default:
-			err = errors.Join(
-				err,
-				errors.New(fmt.Sprintf("pem type %s not supported.\n", block.Type)))
+			log.Printf("WARNING: %s: pem type %s not supported.", fileName, block.Type)
 		}
 	}
 
 	return
 }
+
+// warn_expiry warns if pCertificate found in source is expired or expires within warningWindow.
+func warn_expiry(source string, pCertificate *x509.Certificate, warningWindow time.Duration) {
+	now := time.Now()
+	switch {
+	case now.After(pCertificate.NotAfter):
+		log.Printf("WARNING: %s: certificate %s expired on %s", source, pCertificate.Subject, pCertificate.NotAfter.Format(time.DateOnly))
+	case now.Add(warningWindow).After(pCertificate.NotAfter):
+		log.Printf("WARNING: %s: certificate %s expires on %s", source, pCertificate.Subject, pCertificate.NotAfter.Format(time.DateOnly))
+	case now.Before(pCertificate.NotBefore):
+		log.Printf("WARNING: %s: certificate %s not valid before %s", source, pCertificate.Subject, pCertificate.NotBefore.Format(time.DateOnly))
+	}
+}
+
+// describe_cert returns subject, expiry and SHA-256 fingerprint of pCertificate.
+func describe_cert(pCertificate *x509.Certificate) string {
+	sum := sha256.Sum256(pCertificate.Raw)
+	fingerprint := make([]string, len(sum))
+	for i, b := range sum {
+		fingerprint[i] = fmt.Sprintf("%02X", b)
+	}
+
+	return fmt.Sprintf(
+		"%s  expires %s  sha256 %s",
+		pCertificate.Subject,
+		pCertificate.NotAfter.Format(time.DateOnly),
+		strings.Join(fingerprint, ":"))
+}
@@ -7,7 +7,12 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/itchyny/timefmt-go"
 	"gopkg.in/yaml.v3"
@@ -16,29 +21,98 @@ import (
 // structs describing structure of yaml config file.
 
 type goifo_conf_s struct {
-	Servers []server_s `yaml:""`
+	Concurrency       int           `yaml:",omitempty"`
+	Interval          time.Duration `yaml:",omitempty"`
+	Cron              string        `yaml:",omitempty"`
+	LogLevel          string        `yaml:"log_level,omitempty"`
+	CertWarningWindow time.Duration `yaml:"cert_warning_window,omitempty"`
+	Servers           []server_s    `yaml:""`
 }
 
 type server_s struct {
-	Host           string      `yaml: ""`
-	NoTLS          bool        `yaml: ",omitempty"`
-	NoSimpleLogin  bool        `yaml: ",omitempty"`
-	NoSASLPlain    bool        `yaml: ",omitempty"`
-	NoSASLExternal bool        `yaml: ",omitempty"`
-	Username       string      `yaml: ",omitempty"`
-	Password       string      `yaml: ",omitempty"`
-	Identity       string      `yaml: ",omitempty"`
-	Mailboxes      []mailbox_s `yaml: ",omitempty"`
+	Host                  string        `yaml: ""`
+	Port                  int           `yaml:",omitempty"`
+	ConnectTimeout        time.Duration `yaml:"connect_timeout,omitempty"`
+	LocalAddress          string        `yaml:"local_address,omitempty"`
+	Proxy                 string        `yaml:",omitempty"`
+	NoTLS                 bool          `yaml: ",omitempty"`
+	TLS                   string        `yaml:"tls,omitempty"`
+	ClientCert            string        `yaml:"client_cert,omitempty"`
+	ClientKey             string        `yaml:"client_key,omitempty"`
+	CAFile                string        `yaml:"ca_file,omitempty"`
+	CAFileOnly            bool          `yaml:"ca_file_only,omitempty"`
+	PinSHA256             []string      `yaml:"pin_sha256,omitempty"`
+	TLSMinVersion         string        `yaml:"tls_min_version,omitempty"`
+	ServerName            string        `yaml:"server_name,omitempty"`
+	TLSInsecureSkipVerify bool          `yaml:"tls_insecure_skip_verify,omitempty"`
+	AllowPlainAuth        bool          `yaml:"allow_plaintext_auth,omitempty"`
+	NoSimpleLogin         bool          `yaml: ",omitempty"`
+	NoSASLPlain           bool          `yaml: ",omitempty"`
+	NoSASLExternal        bool          `yaml: ",omitempty"`
+	Username              string        `yaml: ",omitempty"`
+	Password              string        `yaml: ",omitempty"`
+	PasswordCmd           string        `yaml:"password_command,omitempty"`
+	PasswordEnv           string        `yaml:"password_env,omitempty"`
+	PasswordFile          string        `yaml:"password_file,omitempty"`
+	Identity              string        `yaml: ",omitempty"`
+	Auth                  string        `yaml:",omitempty"`
+	OAuth2                oauth2_s      `yaml:",omitempty"`
+	Trash                 string        `yaml:",omitempty"`
+	MaxMatches            yaml.Node     `yaml:"max_matches,omitempty"`
+	LogLevel              string        `yaml:"log_level,omitempty"`
+	Retries               int           `yaml:",omitempty"`
+	RetryDelay            time.Duration `yaml:"retry_delay,omitempty"`
+	RetryMaxDelay         time.Duration `yaml:"retry_max_delay,omitempty"`
+	Mailboxes             []mailbox_s   `yaml: ",omitempty"`
+}
+
+// oauth2_s describes how to obtain access tokens for xoauth2 or oauthbearer authentication.
+type oauth2_s struct {
+	TokenEndpoint string `yaml:"token_endpoint"`
+	ClientID      string `yaml:"client_id"`
+	ClientSecret  string `yaml:"client_secret,omitempty"`
+	RefreshToken  string `yaml:"refresh_token"`
 }
 
 type mailbox_s struct {
-	Name  string      `yaml: ""`
-	Rules []yaml.Node `yaml: ",omitempty"`
+	Name       string      `yaml: ""`
+	MaxMatches yaml.Node   `yaml:"max_matches,omitempty"`
+	Idle       bool        `yaml:",omitempty"`
+	Rules      []yaml.Node `yaml: ",omitempty"`
 }
 
 type rule_s struct {
-	Preconditions []yaml.Node            `yaml: ""`
-	Action        map[string][]yaml.Node `yaml: ""`
+	Preconditions []yaml.Node          `yaml: ""`
+	Action        map[string]yaml.Node `yaml: ""`
+	MaxMatches    yaml.Node            `yaml:"max_matches,omitempty"`
+	Incremental   bool                 `yaml:",omitempty"`
+}
+
+// maxMatches_s is an upper bound of the number of emails a rule may match.
+// It is given by max_matches in config file either as absolute number or as percentage
+// of the number of emails in a mailbox, e.g. 50 or 10%.
+type maxMatches_s struct {
+	isSet        bool    // false if no upper bound is given.
+	value        float64 // absolute number or percentage.
+	isPercentage bool
+}
+
+// isExceeded checks whether nrMatches emails found in a mailbox containing nrEmails emails exceed this bound.
+func (m maxMatches_s) isExceeded(nrMatches uint32, nrEmails uint32) bool {
+	if !m.isSet {
+		return false
+	}
+	if m.isPercentage {
+		return float64(nrMatches) > m.value*float64(nrEmails)/100
+	}
+	return float64(nrMatches) > m.value
+}
+
+func (m maxMatches_s) String() string {
+	if m.isPercentage {
+		return fmt.Sprintf("%g%%", m.value)
+	}
+	return fmt.Sprintf("%g", m.value)
 }
 
 type precondition_s struct {
@@ -60,6 +134,17 @@ func loadConfig(actualConfigFile string, pConfigData *goifo_conf_s) (err error)
 		return
 	}
 
+	if pConfigData.CertWarningWindow == 0 {
+		pConfigData.CertWarningWindow = defaultCertWarningWindow
+	}
+
+	// servers inherit global settings.
+	for i := range pConfigData.Servers {
+		if pConfigData.Servers[i].LogLevel == "" {
+			pConfigData.Servers[i].LogLevel = pConfigData.LogLevel
+		}
+	}
+
 	return
 }
 
@@ -68,15 +153,34 @@ func loadConfig(actualConfigFile string, pConfigData *goifo_conf_s) (err error)
 // cf. [https://pkg.go.dev/github.com/mxk/go-imap/imap#Client.Search]
 type iStringCollector interface {
 	append(s string)
+	appendRegex(header string, pRegexp *regexp.Regexp, isNegated bool) // add a search key matched locally against header or, if header is empty, against body.
+}
+
+// negatedCollector_s is an iStringCollector used below a NOT precondition.
+// It forwards search keys to the enclosing collector and flips the polarity of regular expressions.
+type negatedCollector_s struct {
+	iStringCollector
+}
+
+func (c negatedCollector_s) appendRegex(header string, pRegexp *regexp.Regexp, isNegated bool) {
+	c.iStringCollector.appendRegex(header, pRegexp, !isNegated)
 }
 
 // iRuleProcessor is a callback interface for structs implementing
 // imap operations for processing a rule.
 type iRuleProcessor interface {
 	iStringCollector
-	search() (err error)          // perform imap's SEARCH command for processing preconditions
-	move(dest string) (err error) // perform imap's COPY command for copying emails processing move actions
-	markSrcForDel() (err error)   // mark emails as deleted by imap's STORE command so that emails are erased after closing mailbox.
+	search() (err error)                               // perform imap's SEARCH command for processing preconditions
+	copy(dest string) (err error)                      // perform imap's COPY command for copying emails processing copy actions
+	move(dest string) (err error)                      // perform imap's COPY command for copying emails processing move actions
+	countMatches() (nrMatches uint32, nrEmails uint32) // number of emails found by search and number of emails in mailbox.
+	markSrcForDel() (err error)                        // mark emails as deleted by imap's STORE command so that emails are erased after closing mailbox.
+	moveToTrash() (err error)                          // copy emails to trash mailbox, part of processing delete actions.
+	flag(flags []string) (err error)                   // set flags and keywords by imap's STORE command processing flag actions.
+	unflag(flags []string) (err error)                 // clear flags and keywords by imap's STORE command processing unflag actions.
+	restrictToNew(digest string) (err error)           // restrict search to emails incremental rule given by digest did not examine on former runs.
+	restrictToChanged(digest string)                   // restrict search to emails changed since rule given by digest succeeded on them.
+	classify(err error) error                          // mark err of processing rule as transient or permanent so that retrying is decided.
 }
 
 // iMailboxProcessor is a callback interface for structs implementing
@@ -85,6 +189,8 @@ type iMailboxProcessor interface {
 	selectMailbox(name string) (err error) // perform imap's SELECT command opening a mailbox.
 	newRuleProcessor() iRuleProcessor      // produce iRuleProcessor for processing rules related to this mailbox.
 	close() (err error)                    // perform imap's CLOSE command for shutting down a mailbox and deleting marked emails.
+	reopen() (err error)                   // reconnect imap server and select mailbox again after a transient failure.
+	commit() (err error)                   // remember emails examined so that incremental rules skip them next time.
 }
 
 // iServerProcessor is a callback interface for structs implementing
@@ -92,16 +198,23 @@ type iMailboxProcessor interface {
 type iServerProcessor interface {
 	connect(
 		host string,
-		noTLS bool,
+		tlsMode string,
 		noSimpleLogin bool,
 		noSASLPlainLogin bool,
 		noSASLExternal bool,
 		username string,
-		password string,
+		getCredentials func() (password string, accessToken string, err error),
 		identity string,
-		pTLSConfig *tls.Config) (err error) // connects an imap server and authenticate
-	newMailboxProcessor() iMailboxProcessor // produce iMailboxProcessor for processing mailbox related to this server.
-	logout() (err error)                    // perform imap's LOGOUT command for shutting down imap sessions.
+		auth string,
+		logLevel string,
+		allowPlaintextAuth bool,
+		pDialer *dialer_s,
+		pTLSConfig *tls.Config) (err error) // connects an imap server and authenticate.  getCredentials is called on dialing only.
+	getAccessToken(host string, username string, pOAuth2 *oauth2_s) (accessToken string, err error) // obtain an OAuth2 access token for authentication.
+	getPassword(pServer *server_s) (password string, err error)                                     // resolve password from config file, command, environment variable or file.
+	setTrash(name string) (err error)                                                               // set trash mailbox.  If name is empty it is detected by imap's LIST command.
+	newMailboxProcessor() iMailboxProcessor                                                         // produce iMailboxProcessor for processing mailbox related to this server.
+	logout() (err error)                                                                            // perform imap's LOGOUT command for shutting down imap sessions.
 }
 
 // iConfigProcessor is a callback interface for structs implementing
@@ -120,10 +233,21 @@ type dryRunRuleProcessor_s struct {
 func (processor dryRunRuleProcessor_s) append(s string) {
 }
 
+func (processor dryRunRuleProcessor_s) appendRegex(header string, pRegexp *regexp.Regexp, isNegated bool) {
+}
+
 func (processor dryRunRuleProcessor_s) search() (err error) {
 	return
 }
 
+func (processor dryRunRuleProcessor_s) countMatches() (nrMatches uint32, nrEmails uint32) {
+	return
+}
+
+func (processor dryRunRuleProcessor_s) copy(dest string) (err error) {
+	return
+}
+
 func (processor dryRunRuleProcessor_s) move(dest string) (err error) {
 	return
 }
@@ -132,6 +256,29 @@ func (processor dryRunRuleProcessor_s) markSrcForDel() (err error) {
 	return
 }
 
+func (processor dryRunRuleProcessor_s) moveToTrash() (err error) {
+	return
+}
+
+func (processor dryRunRuleProcessor_s) flag(flags []string) (err error) {
+	return
+}
+
+func (processor dryRunRuleProcessor_s) unflag(flags []string) (err error) {
+	return
+}
+
+func (processor dryRunRuleProcessor_s) restrictToNew(digest string) (err error) {
+	return
+}
+
+func (processor dryRunRuleProcessor_s) restrictToChanged(digest string) {
+}
+
+func (processor dryRunRuleProcessor_s) classify(err error) error {
+	return err
+}
+
 type dryRunMailboxProcessor_s struct {
 }
 
@@ -143,23 +290,52 @@ func (processor dryRunMailboxProcessor_s) newRuleProcessor() iRuleProcessor {
 	return dryRunRuleProcessor_s{}
 }
 
+func (processor dryRunMailboxProcessor_s) reopen() (err error) {
+	return
+}
+
 func (processor dryRunMailboxProcessor_s) close() (err error) {
 	return
 }
 
+func (processor dryRunMailboxProcessor_s) commit() (err error) {
+	return
+}
+
 type dryRunServerProcessor_s struct {
 }
 
 func (processor dryRunServerProcessor_s) connect(
 	host string,
-	noTLS bool,
+	tlsMode string,
 	noSimpleLogin bool,
 	noSASLPlainLogin bool,
 	noSASLExternal bool,
 	username string,
-	password string,
+	getCredentials func() (password string, accessToken string, err error),
 	identity string,
+	auth string,
+	logLevel string,
+	allowPlaintextAuth bool,
+	pDialer *dialer_s,
 	pTLSConfig *tls.Config) (err error) {
+	_, _, err = getCredentials()
+	return
+}
+
+// getAccessToken checks whether everything needed for obtaining an access token is given.
+func (processor dryRunServerProcessor_s) getAccessToken(host string, username string, pOAuth2 *oauth2_s) (accessToken string, err error) {
+	err = check_oauth2(host, username, pOAuth2)
+	return
+}
+
+// getPassword checks whether password is resolvable without running password_command.
+func (processor dryRunServerProcessor_s) getPassword(pServer *server_s) (password string, err error) {
+	err = check_password(pServer)
+	return
+}
+
+func (processor dryRunServerProcessor_s) setTrash(name string) (err error) {
 	return
 }
 
@@ -205,7 +381,7 @@ type argLengthError struct {
 }
 
 // actionNotDefined is issued if action is unknown.
-// The only action admitted so far is move.
+// Admitted actions are enumerated in actionOrder.
 type actionNotDefinedError struct {
 	line        int
 	column      int
@@ -220,6 +396,64 @@ func (e argLengthError) Error() string {
 	return weaveLocation(e.line, e.column, fmt.Sprintf("search field %s takes %d args.  %d args given", e.searchField, e.nrArgExpected, e.nrArgActual))
 }
 
+// deleteModeError is issued if the argument of a delete action is neither trash nor permanent.
+type deleteModeError struct {
+	line   int
+	column int
+	mode   string
+}
+
+func (e deleteModeError) Error() string {
+	return weaveLocation(e.line, e.column, fmt.Sprintf("delete mode %s is neither trash nor permanent", e.mode))
+}
+
+// maxMatchesError is issued if max_matches is neither a number nor a percentage.
+type maxMatchesError struct {
+	line       int
+	column     int
+	maxMatches string
+}
+
+func (e maxMatchesError) Error() string {
+	return weaveLocation(e.line, e.column, fmt.Sprintf("max_matches %s is neither a number nor a percentage", e.maxMatches))
+}
+
+// tooManyMatchesError is issued if a rule matches more emails than admitted by max_matches.
+type tooManyMatchesError struct {
+	line       int
+	column     int
+	nrMatches  uint32
+	nrEmails   uint32
+	maxMatches maxMatches_s
+}
+
+func (e tooManyMatchesError) Error() string {
+	return weaveLocation(e.line, e.column, fmt.Sprintf("rule matches %d of %d emails exceeding max_matches %v.  rule skipped", e.nrMatches, e.nrEmails, e.maxMatches))
+}
+
+// regexError is issued if a regular expression given in REGEX_HEADER or REGEX_BODY preconditions cannot be compiled.
+type regexError struct {
+	line   int
+	column int
+	err    error
+}
+
+func (e regexError) Error() string {
+	return weaveLocation(e.line, e.column, e.err.Error())
+}
+
+// flagError is issued if a flag given in flag or unflag actions is neither an admitted
+// system flag nor a valid keyword.
+type flagError struct {
+	line   int
+	column int
+	flag   string
+}
+
+func (e flagError) Error() string {
+	return weaveLocation(e.line, e.column, fmt.Sprintf("flag %s is not admitted", e.flag))
+}
+
 // process_string_value provides a string for using as search key in imap's SEARCH command.
 func process_string_value(collector iStringCollector, pValue *yaml.Node) (err error) {
 	var s string
@@ -276,6 +510,26 @@ func process_time_value(collector iStringCollector, pValue *yaml.Node) (err erro
 	return
 }
 
+// process_regex_value provides a regular expression matched locally against header named header or,
+// if header is empty, against body of emails.
+func process_regex_value(collector iStringCollector, header string, pValue *yaml.Node) (err error) {
+	var s string
+	err = pValue.Decode(&s)
+	if err != nil {
+		return
+	}
+
+	pRegexp, compileError := regexp.Compile(s)
+	if compileError != nil {
+		err = regexError{pValue.Line, pValue.Column, compileError}
+		return
+	}
+
+	collector.appendRegex(header, pRegexp, false)
+
+	return
+}
+
 // process a precondition, i.e. it provides search keys for use in imap's SEARCH command.
 func process_precondition(collector iStringCollector, pValue *yaml.Node) (err error) {
 	var precondition precondition_s
@@ -376,6 +630,7 @@ func process_precondition(collector iStringCollector, pValue *yaml.Node) (err er
 		}
 		err = process_uint32_value(collector, &precondition.Values[0])
 	case "MSG":
+		// sequence numbers even though rules are processed by imap's UID SEARCH command.
 		for _, v := range precondition.Values {
 			err = process_uint32_value(collector, &v)
 			if err != nil {
@@ -394,7 +649,7 @@ func process_precondition(collector iStringCollector, pValue *yaml.Node) (err er
 			err = argLengthError{pValue.Line, pValue.Column, f, l, 1}
 			return
 		}
-		err = process_precondition(collector, &precondition.Values[0])
+		err = process_precondition(negatedCollector_s{collector}, &precondition.Values[0])
 	case "OLD":
 		collector.append(f)
 		if l := uint32(len(precondition.Values)); l != 0 {
@@ -430,6 +685,27 @@ func process_precondition(collector iStringCollector, pValue *yaml.Node) (err er
 			err = argLengthError{pValue.Line, pValue.Column, f, l, 0}
 			return
 		}
+	case "REGEX_BODY":
+		if l := uint32(len(precondition.Values)); l != 1 {
+			err = argLengthError{pValue.Line, pValue.Column, f, l, 1}
+			return
+		}
+		err = process_regex_value(collector, "", &precondition.Values[0])
+	case "REGEX_HEADER":
+		if l := uint32(len(precondition.Values)); l != 2 {
+			err = argLengthError{pValue.Line, pValue.Column, f, l, 2}
+			return
+		}
+		var header string
+		err = precondition.Values[0].Decode(&header)
+		if err != nil {
+			return
+		}
+		if header == "" || strings.ContainsAny(header, " :()[]\"") {
+			err = regexError{precondition.Values[0].Line, precondition.Values[0].Column, fmt.Errorf("%q is not a header name", header)}
+			return
+		}
+		err = process_regex_value(collector, header, &precondition.Values[1])
 	case "SEEN":
 		collector.append(f)
 		if l := uint32(len(precondition.Values)); l != 0 {
@@ -546,8 +822,35 @@ func process_precondition(collector iStringCollector, pValue *yaml.Node) (err er
 	return
 }
 
-// process_move_action perform the copy part of a move action instructed by a rule.
-func process_move_action(processor iRuleProcessor, v []yaml.Node) (err error) {
+// process_max_matches interprets max_matches given in config file.
+// If it is not given in pValue limit inherited from enclosing mailbox or server is returned.
+func process_max_matches(pValue *yaml.Node, inherited maxMatches_s) (limit maxMatches_s, err error) {
+	limit = inherited
+	if pValue.IsZero() {
+		return
+	}
+
+	var s string
+	err = pValue.Decode(&s)
+	if err != nil {
+		return
+	}
+
+	number, isPercentage := strings.CutSuffix(s, "%")
+	value, parseError := strconv.ParseFloat(number, 64)
+	if parseError != nil || value < 0 || (isPercentage && value > 100) || (!isPercentage && value != float64(uint32(value))) {
+		err = maxMatchesError{pValue.Line, pValue.Column, s}
+		return
+	}
+
+	limit = maxMatches_s{isSet: true, value: value, isPercentage: isPercentage}
+
+	return
+}
+
+// process_move_action perform the copy part of a move action or a copy action instructed by a rule.
+// copy is either move or copy method of an iRuleProcessor.
+func process_move_action(copy func(dest string) error, v []yaml.Node) (err error) {
 	for _, destRaw := range v {
 		var dest string
 		decodeError := destRaw.Decode(&dest)
@@ -556,7 +859,7 @@ func process_move_action(processor iRuleProcessor, v []yaml.Node) (err error) {
 			continue
 		}
 		{
-			moveError := processor.move(dest)
+			moveError := copy(dest)
 			if moveError != nil {
 				err = errors.Join(err, moveError)
 				return
@@ -567,14 +870,125 @@ func process_move_action(processor iRuleProcessor, v []yaml.Node) (err error) {
 	return
 }
 
+// systemFlags enumerates system flags admitted in flag and unflag actions.
+// \Deleted is not admitted since deleting emails is left to move actions.
+var systemFlags = map[string]bool{
+	"\\Seen":     true,
+	"\\Answered": true,
+	"\\Flagged":  true,
+	"\\Draft":    true,
+}
+
+// isFlagAdmitted checks whether flag is an admitted system flag or a keyword, i.e. an imap atom.
+// cf. [https://www.rfc-editor.org/rfc/rfc3501#section-9]
+func isFlagAdmitted(flag string) bool {
+	if strings.HasPrefix(flag, "\\") {
+		return systemFlags[flag]
+	}
+
+	return flag != "" && !strings.ContainsAny(flag, "(){ %*\"]\\") && strings.IndexFunc(flag, unicode.IsControl) < 0
+}
+
+// process_flag_action performs a flag or an unflag action instructed by a rule.
+// store is either flag or unflag method of an iRuleProcessor.
+func process_flag_action(store func(flags []string) error, v []yaml.Node) (err error) {
+	flags := []string{}
+	for _, flagRaw := range v {
+		var flag string
+		decodeError := flagRaw.Decode(&flag)
+		if decodeError != nil {
+			err = errors.Join(err, decodeError)
+			continue
+		}
+		if !isFlagAdmitted(flag) {
+			err = errors.Join(err, flagError{flagRaw.Line, flagRaw.Column, flag})
+			continue
+		}
+		flags = append(flags, flag)
+	}
+
+	if err != nil || len(flags) == 0 {
+		return
+	}
+
+	err = store(flags)
+
+	return
+}
+
+// actionOrder enumerates admitted actions in the order they are performed.
+// Flags are set before copying so that copies carry them.
+var actionOrder = []string{"flag", "unflag", "copy", "move", "delete"}
+
+// process_delete_action performs a delete action instructed by a rule.
+// Emails are copied to trash mailbox unless argument is permanent.  In both cases
+// isSrcToBeDeleted is set so that emails are marked as deleted and erased after closing mailbox.
+func process_delete_action(processor iRuleProcessor, pValue *yaml.Node) (isSrcToBeDeleted bool, err error) {
+	var mode string
+	err = pValue.Decode(&mode)
+	if err != nil {
+		return
+	}
+
+	switch mode {
+	case "trash":
+		err = processor.moveToTrash()
+		isSrcToBeDeleted = err == nil
+	case "permanent":
+		isSrcToBeDeleted = true
+	default:
+		err = deleteModeError{pValue.Line, pValue.Column, mode}
+	}
+
+	return
+}
+
+// is_time_dependent tells whether preconditions may match emails not changed since former runs.
+// This is the case for preconditions relative to now or to the imap session and for
+// sequence numbers shifting if emails are expunged.
+func is_time_dependent(preconditions []yaml.Node) bool {
+	for i := range preconditions {
+		var precondition precondition_s
+		if preconditions[i].Decode(&precondition) != nil {
+			return true
+		}
+
+		switch precondition.Field {
+		case "MSG", "NEW", "OLD", "OLDERTHAN", "RECENT":
+			return true
+		case "NOT", "OR":
+			if is_time_dependent(precondition.Values) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 // process_rule perform actions related to a rule.
-func process_rule(processor iRuleProcessor, pRule *yaml.Node) (err error) {
+// Rule is skipped if it matches more emails than admitted by limit or by its own max_matches.
+func process_rule(processor iRuleProcessor, pRule *yaml.Node, limit maxMatches_s) (err error) {
 	var rule rule_s
 	err = pRule.Decode(&rule)
 	if err != nil {
 		return
 	}
 
+	limit, err = process_max_matches(&rule.MaxMatches, limit)
+	if err != nil {
+		return
+	}
+
+	digest := ruleDigest(pRule)
+
+	if rule.Incremental {
+		err = processor.restrictToNew(digest)
+		if err != nil {
+			return
+		}
+	}
+
 	for _, precondition := range rule.Preconditions {
 		err = errors.Join(err, process_precondition(processor, &precondition))
 	}
@@ -583,30 +997,106 @@ func process_rule(processor iRuleProcessor, pRule *yaml.Node) (err error) {
 		return
 	}
 
+	// emails a rule not depending on time did not match before keep not matching unless they change.
+	if !is_time_dependent(rule.Preconditions) {
+		processor.restrictToChanged(digest)
+	}
+
 	err = processor.search()
 	if err != nil {
 		return
 	}
 
+	if nrMatches, nrEmails := processor.countMatches(); limit.isExceeded(nrMatches, nrEmails) {
+		err = tooManyMatchesError{pRule.Line, pRule.Column, nrMatches, nrEmails, limit}
+		return
+	}
+
+	for k := range rule.Action {
+		isActionDefined := false
+		for _, action := range actionOrder {
+			isActionDefined = isActionDefined || action == k
+		}
+		if !isActionDefined {
+			err = errors.Join(err, actionNotDefinedError{pRule.Line, pRule.Column, k})
+		}
+	}
+
+	if err != nil {
+		return
+	}
+
 	{
 		isSrcToBeDeleted := false
 
-		for k, v := range rule.Action {
+		for _, k := range actionOrder {
+			node, ok := rule.Action[k]
+			if !ok {
+				continue
+			}
+
+			var v []yaml.Node
+			if k != "delete" {
+				err = node.Decode(&v)
+				if err != nil {
+					return
+				}
+			}
+
 			switch k {
-			case "move":
+			case "flag":
 				{
-					moveError := process_move_action(processor, v)
+					flagError := process_flag_action(processor.flag, v)
+					if flagError != nil {
+						err = errors.Join(err, flagError)
+						return
+					}
+				}
+			case "unflag":
+				{
+					unflagError := process_flag_action(processor.unflag, v)
+					if unflagError != nil {
+						err = errors.Join(err, unflagError)
+						return
+					}
+				}
+			case "copy":
+				{
+					copyError := process_move_action(processor.copy, v)
+					if copyError != nil {
+						err = errors.Join(err, copyError)
+						return
+					}
+				}
+			case "move":
+				if len(v) == 0 {
+					// An empty list of destinations means deleting emails by moving them to trash.
+					trashError := processor.moveToTrash()
+					if trashError != nil {
+						err = errors.Join(err, trashError)
+						return
+					}
+				} else {
+					moveError := process_move_action(processor.move, v)
 					if moveError != nil {
 						err = errors.Join(err, moveError)
 						return
 					}
 				}
 				isSrcToBeDeleted = true
-			default:
-				err = errors.Join(err, actionNotDefinedError{pRule.Line, pRule.Column, k})
+			case "delete":
+				{
+					isPermanent, deleteError := process_delete_action(processor, &node)
+					if deleteError != nil {
+						err = errors.Join(err, deleteError)
+						return
+					}
+					isSrcToBeDeleted = isSrcToBeDeleted || isPermanent
+				}
 			}
 		}
 
+		// markSrcForDel is called once even if several actions delete emails.
 		if isSrcToBeDeleted {
 			err = errors.Join(err, processor.markSrcForDel())
 		}
@@ -616,36 +1106,156 @@ func process_rule(processor iRuleProcessor, pRule *yaml.Node) (err error) {
 }
 
 // process_mailbox performs actions related to a mailbox.
-func process_mailbox(processor iMailboxProcessor, pMailbox *mailbox_s) (err error) {
-	err = processor.selectMailbox(pMailbox.Name)
+// limit is the upper bound of emails a rule may match inherited from server.
+// Rules failing transiently are retried according to retry after reopening mailbox.
+func process_mailbox(processor iMailboxProcessor, pMailbox *mailbox_s, limit maxMatches_s, retry retry_s) (err error) {
+	limit, err = process_max_matches(&pMailbox.MaxMatches, limit)
 	if err != nil {
 		return
 	}
 
+	// imap servers respond INUSE or UNAVAILABLE mostly on selecting a mailbox.
+	err = retry.do(
+		fmt.Sprintf("%s select", pMailbox.Name),
+		func() error {
+			return processor.selectMailbox(pMailbox.Name)
+		},
+		processor.reopen)
+	if err != nil {
+		return
+	}
+
+	// emails are remembered as examined only if each rule succeeded.
 	defer func() {
 		err = errors.Join(err, processor.close())
+		if err == nil {
+			err = processor.commit()
+		}
 	}()
 
-	for _, rule := range pMailbox.Rules {
-		ruleProcessor := processor.newRuleProcessor()
-		err = errors.Join(err, process_rule(ruleProcessor, &rule))
+	for i, rule := range pMailbox.Rules {
+		err = errors.Join(err, retry.do(
+			fmt.Sprintf("%s rule #%d", pMailbox.Name, i+1),
+			func() error {
+				ruleProcessor := processor.newRuleProcessor()
+				return ruleProcessor.classify(process_rule(ruleProcessor, &rule, limit))
+			},
+			processor.reopen))
 	}
 
 	return
 }
 
-// process_server performs actions related to a server.
-func process_server(processor iServerProcessor, pServer *server_s, pTLSConfig *tls.Config) (err error) {
+// tls_mode returns how the connection to server described by pServer is encrypted:
+// implicit (TLS from the start), starttls (upgrade by imap's STARTTLS command) or none.
+// If tls is not given notls decides between implicit and starttls.
+func tls_mode(pServer *server_s) (mode string, err error) {
+	switch pServer.TLS {
+	case "":
+		mode = "implicit"
+		if pServer.NoTLS {
+			mode = "starttls"
+		}
+	case "implicit", "starttls", "none":
+		if pServer.NoTLS {
+			err = fmt.Errorf("%s: either tls or notls admitted", pServer.Host)
+			return
+		}
+		mode = pServer.TLS
+	default:
+		err = fmt.Errorf("%s: unknown tls %s.  admitted are implicit, starttls and none", pServer.Host, pServer.TLS)
+	}
+
+	return
+}
+
+// connect_server connects the server described by pServer.
+// Password is resolved and, if OAuth2 authentication is requested, an access token is obtained before.
+func connect_server(processor iServerProcessor, pServer *server_s, pTLSConfig *tls.Config) (err error) {
+	switch pServer.Auth {
+	case "", "xoauth2", "oauthbearer":
+	default:
+		err = fmt.Errorf("%s: unknown auth %s.  admitted are xoauth2 and oauthbearer", pServer.Host, pServer.Auth)
+		return
+	}
+
+	// credentials are resolved on dialing imap server only, i.e. not if an imap session
+	// kept open by daemon is reused.
+	getCredentials := func() (password string, accessToken string, err error) {
+		password, err = processor.getPassword(pServer)
+		if err != nil || pServer.Auth == "" {
+			return
+		}
+		accessToken, err = processor.getAccessToken(pServer.Host, pServer.Username, &pServer.OAuth2)
+		return
+	}
+
+	tlsMode, err := tls_mode(pServer)
+	if err != nil {
+		return
+	}
+
+	pDialer, err := newDialer(pServer, tlsMode)
+	if err != nil {
+		return
+	}
+
+	pServerTLSConfig, err := server_tls_config(pServer, pTLSConfig)
+	if err != nil {
+		return
+	}
+
+	if _, err = logMask(pServer.LogLevel); err != nil {
+		err = fmt.Errorf("%s: %w", pServer.Host, err)
+		return
+	}
+
 	err = processor.connect(
 		pServer.Host,
-		pServer.NoTLS,
+		tlsMode,
 		pServer.NoSimpleLogin,
 		pServer.NoSASLPlain,
 		pServer.NoSASLExternal,
 		pServer.Username,
-		pServer.Password,
+		getCredentials,
 		pServer.Identity,
-		pTLSConfig)
+		pServer.Auth,
+		pServer.LogLevel,
+		pServer.AllowPlainAuth,
+		pDialer,
+		pServerTLSConfig)
+
+	return
+}
+
+// process_server performs actions related to a server.
+// Outcomes of the server and of each mailbox are recorded in pReport.
+func process_server(processor iServerProcessor, pServer *server_s, pTLSConfig *tls.Config, pReport *report_s) (err error) {
+	var mailboxErrors error // recorded in pReport already.
+
+	defer func() {
+		if err != nil {
+			pReport.add(pServer.Host, "", err)
+		}
+		err = errors.Join(err, mailboxErrors)
+	}()
+
+	limit, err := process_max_matches(&pServer.MaxMatches, maxMatches_s{})
+	if err != nil {
+		return
+	}
+
+	retry, err := retry_policy(pServer)
+	if err != nil {
+		return
+	}
+
+	err = retry.do(
+		"connect",
+		func() error {
+			return connect_server(processor, pServer, pTLSConfig)
+		},
+		nil)
 	if err != nil {
 		return
 	}
@@ -654,19 +1264,66 @@ func process_server(processor iServerProcessor, pServer *server_s, pTLSConfig *t
 		err = errors.Join(err, processor.logout())
 	}()
 
+	err = processor.setTrash(pServer.Trash)
+	if err != nil {
+		return
+	}
+
 	for _, mailbox := range pServer.Mailboxes {
+		if stopRequested.Load() {
+			break
+		}
 		mailboxProcessor := processor.newMailboxProcessor()
-		err = errors.Join(err, process_mailbox(mailboxProcessor, &mailbox))
+		unlock := lock_mailbox(pServer, &mailbox)
+		mailboxError := process_mailbox(mailboxProcessor, &mailbox, limit, retry)
+		unlock()
+		pReport.add(pServer.Host, mailbox.Name, mailboxError)
+		mailboxErrors = errors.Join(mailboxErrors, mailboxError)
 	}
 
 	return
 }
 
 // process_goifo_conf performs actions instructed by yaml config file.
-func process_goifo_conf(processor iConfigProcessor, pConfigData *goifo_conf_s, pTLSConfig *tls.Config) (err error) {
-	for _, server := range pConfigData.Servers {
+// Up to concurrency servers are processed in parallel, each by its own iServerProcessor.
+// A failing server does not keep the remaining ones from being processed.
+// If daemon has to shut down no more servers and mailboxes are processed.
+// If pReport is not nil outcomes are recorded there in the order of config file.
+func process_goifo_conf(processor iConfigProcessor, pConfigData *goifo_conf_s, pTLSConfig *tls.Config, pReport *report_s) (err error) {
+	concurrency := pConfigData.Concurrency
+	switch {
+	case concurrency < 0:
+		err = errors.New("concurrency must not be negative")
+		return
+	case concurrency == 0:
+		concurrency = 1
+	}
+
+	serverErrors := make([]error, len(pConfigData.Servers))
+	serverReports := make([]report_s, len(pConfigData.Servers))
+	semaphore := make(chan struct{}, concurrency)
+	var waitGroup sync.WaitGroup
+
+	for i := range pConfigData.Servers {
+		if stopRequested.Load() {
+			break
+		}
 		serverProcessor := processor.newServerProcessor()
-		err = errors.Join(err, process_server(serverProcessor, &server, pTLSConfig))
+		semaphore <- struct{}{}
+		waitGroup.Add(1)
+		go func(i int) {
+			defer func() {
+				<-semaphore
+				waitGroup.Done()
+			}()
+			serverErrors[i] = process_server(serverProcessor, &pConfigData.Servers[i], pTLSConfig, &serverReports[i])
+		}(i)
+	}
+	waitGroup.Wait()
+
+	for i := range pConfigData.Servers {
+		err = errors.Join(err, serverErrors[i])
+		pReport.merge(&serverReports[i])
 	}
 
 	return
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// yamlNode parses s as the value of a key in config file.
+func yamlNode(t *testing.T, s string) (node yaml.Node) {
+	t.Helper()
+
+	var document yaml.Node
+	if err := yaml.Unmarshal([]byte(s), &document); err != nil {
+		t.Fatal(err)
+	}
+	if len(document.Content) > 0 {
+		node = *document.Content[0]
+	}
+	return
+}
+
+func TestProcessMaxMatches(t *testing.T) {
+	inherited := maxMatches_s{isSet: true, value: 7}
+
+	tests := []struct {
+		name      string
+		value     string // value of max_matches.  Empty if not given.
+		want      string // limit returned.  Empty if an error is expected.
+		wantIsSet bool
+	}{
+		{name: "number", value: "50", want: "50", wantIsSet: true},
+		{name: "percentage", value: "10%", want: "10%", wantIsSet: true},
+		{name: "zero", value: "0", want: "0", wantIsSet: true},
+		{name: "zero percent", value: "0%", want: "0%", wantIsSet: true},
+		{name: "hundred percent", value: "100%", want: "100%", wantIsSet: true},
+		{name: "fraction of percent", value: "2.5%", want: "2.5%", wantIsSet: true},
+		{name: "inherited if not given", value: "", want: "7", wantIsSet: true},
+		{name: "more than hundred percent", value: "101%"},
+		{name: "fraction", value: "2.5"},
+		{name: "negative", value: "-1"},
+		{name: "negative percentage", value: "-1%"},
+		{name: "too big", value: "4294967296"},
+		{name: "no number", value: "many"},
+		{name: "list", value: "[50]"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value := yamlNode(t, test.value)
+			limit, err := process_max_matches(&value, inherited)
+			if test.want == "" {
+				if err == nil {
+					t.Errorf("process_max_matches(%q) = %s, want error", test.value, limit)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if limit.String() != test.want || limit.isSet != test.wantIsSet {
+				t.Errorf("process_max_matches(%q) = %s, want %s", test.value, limit, test.want)
+			}
+		})
+	}
+}
+
+func TestMaxMatchesIsExceeded(t *testing.T) {
+	tests := []struct {
+		limit     maxMatches_s
+		nrMatches uint32
+		nrEmails  uint32
+		want      bool
+	}{
+		{maxMatches_s{}, 1000, 1000, false},
+		{maxMatches_s{isSet: true, value: 50}, 50, 1000, false},
+		{maxMatches_s{isSet: true, value: 50}, 51, 1000, true},
+		{maxMatches_s{isSet: true, value: 0}, 0, 1000, false},
+		{maxMatches_s{isSet: true, value: 0}, 1, 1000, true},
+		{maxMatches_s{isSet: true, value: 10, isPercentage: true}, 5, 50, false},
+		{maxMatches_s{isSet: true, value: 10, isPercentage: true}, 6, 50, true},
+		{maxMatches_s{isSet: true, value: 50, isPercentage: true}, 2, 5, false},
+		{maxMatches_s{isSet: true, value: 50, isPercentage: true}, 3, 5, true},
+		{maxMatches_s{isSet: true, value: 100, isPercentage: true}, 5, 5, false},
+		{maxMatches_s{isSet: true, value: 10, isPercentage: true}, 0, 0, false},
+		{maxMatches_s{isSet: true, value: 0, isPercentage: true}, 1, 5, true},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%d of %d by %s", test.nrMatches, test.nrEmails, test.limit), func(t *testing.T) {
+			if got := test.limit.isExceeded(test.nrMatches, test.nrEmails); got != test.want {
+				t.Errorf("isExceeded(%d, %d) = %v, want %v", test.nrMatches, test.nrEmails, got, test.want)
+			}
+		})
+	}
+}
+
+// matchingServerProcessor_s connects no imap server.  Each rule finds 3 of 5 emails.
+type matchingServerProcessor_s struct {
+	dryRunServerProcessor_s
+}
+
+func (a matchingServerProcessor_s) newMailboxProcessor() iMailboxProcessor {
+	return matchingMailboxProcessor_s{}
+}
+
+type matchingMailboxProcessor_s struct {
+	dryRunMailboxProcessor_s
+}
+
+func (a matchingMailboxProcessor_s) newRuleProcessor() iRuleProcessor {
+	return matchingRuleProcessor_s{}
+}
+
+type matchingRuleProcessor_s struct {
+	dryRunRuleProcessor_s
+}
+
+func (a matchingRuleProcessor_s) countMatches() (nrMatches uint32, nrEmails uint32) {
+	return 3, 5
+}
+
+func TestMaxMatchesInheritance(t *testing.T) {
+	tests := []struct {
+		name      string
+		server    string // max_matches given at server, mailbox and rule.  Empty if not given.
+		mailbox   string
+		rule      string
+		wantSkip  bool
+		wantLimit string // limit reported if rule is skipped.
+	}{
+		{name: "no limit"},
+		{name: "server", server: "2", wantSkip: true, wantLimit: "2"},
+		{name: "mailbox overrides server", server: "2", mailbox: "3"},
+		{name: "rule overrides mailbox", server: "2", mailbox: "3", rule: "2", wantSkip: true, wantLimit: "2"},
+		{name: "rule overrides server", server: "2", rule: "3"},
+		{name: "zero", rule: "0", wantSkip: true, wantLimit: "0"},
+		{name: "percentage exceeded", server: "50%", wantSkip: true, wantLimit: "50%"},
+		{name: "percentage reached", mailbox: "60%"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			maxMatches := func(value string) string {
+				if value == "" {
+					return ""
+				}
+				return fmt.Sprintf("max_matches: %q", value)
+			}
+			config := fmt.Sprintf(`
+host: imap.example.org
+username: user
+password: password
+%s
+mailboxes:
+  - name: INBOX
+    %s
+    rules:
+      - %s
+        preconditions:
+          - field: SEEN
+            values: []
+        action:
+          flag: [x]
+`, maxMatches(test.server), maxMatches(test.mailbox), maxMatches(test.rule))
+			var server server_s
+			if err := yaml.Unmarshal([]byte(config), &server); err != nil {
+				t.Fatal(err)
+			}
+
+			err := process_server(matchingServerProcessor_s{}, &server, &tls.Config{}, &report_s{})
+			var tooManyMatches tooManyMatchesError
+			isSkipped := errors.As(err, &tooManyMatches)
+			if isSkipped != test.wantSkip {
+				t.Fatalf("process_server() error = %v, want rule skipped %v", err, test.wantSkip)
+			}
+			if !isSkipped && err != nil {
+				t.Fatal(err)
+			}
+			if isSkipped && tooManyMatches.maxMatches.String() != test.wantLimit {
+				t.Errorf("rule skipped by limit %s, want %s", tooManyMatches.maxMatches, test.wantLimit)
+			}
+		})
+	}
+}
@@ -20,6 +20,7 @@ var (
 	configDir    string // Most likely ~/.config/goifo
 	configFile   string // Name of config file.  Most likely ~/.config/goifo/config.yaml
 	caFile       string // Name of file containing ca certificates.  Most likely ~/.config/ca.pem
+	stateDir     string // Standard state dir according to XDG.  Most likely ~/.local/state/goifo
 )
 
 // initConstants initialize aforementioned global variables
@@ -34,5 +35,16 @@ func initConstants() (err error) {
 	configFile = filepath.Join(configDir, "config.yaml")
 	caFile = filepath.Join(xdgConfigDir, "ca.pem")
 
+	xdgStateDir := os.Getenv("XDG_STATE_HOME")
+	if xdgStateDir == "" {
+		var homeDir string
+		homeDir, err = os.UserHomeDir()
+		if err != nil {
+			return
+		}
+		xdgStateDir = filepath.Join(homeDir, ".local", "state")
+	}
+	stateDir = filepath.Join(xdgStateDir, projectName)
+
 	return
 }
@@ -0,0 +1,238 @@
+package main
+
+// All stuff about running goifo as a daemon.
+// Config file is processed according to a schedule.  imap sessions are kept open between runs.
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// stopRequested is set if daemon has to shut down.  Processing servers stops after the
+// mailbox being processed is closed.
+var stopRequested atomic.Bool
+
+// sessionPool_s keeps imap sessions which are not in use between runs of daemon.
+type sessionPool_s struct {
+	mutex    sync.Mutex
+	sessions map[string]*serverProcessor_s // by host and username.
+}
+
+// take removes the session kept for key from pool.  nil if there is none.
+func (a *sessionPool_s) take(key string) (pSession *serverProcessor_s) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	pSession = a.sessions[key]
+	delete(a.sessions, key)
+	return
+}
+
+// put keeps pSession in pool for key.  If another session is kept there already
+// pSession is logged out.
+func (a *sessionPool_s) put(key string, pSession *serverProcessor_s) (err error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if _, isKept := a.sessions[key]; isKept {
+		err = pSession.logout()
+		return
+	}
+
+	if a.sessions == nil {
+		a.sessions = make(map[string]*serverProcessor_s)
+	}
+	a.sessions[key] = pSession
+	return
+}
+
+// logout logs out all sessions kept in pool.
+func (a *sessionPool_s) logout() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for key, pSession := range a.sessions {
+		pSession.logout()
+		delete(a.sessions, key)
+	}
+}
+
+// keepAliveServerProcessor_s implements iServerProcessor.
+// It reuses a session kept in pool instead of connecting imap server again and puts
+// it back into pool instead of logging out.
+type keepAliveServerProcessor_s struct {
+	*serverProcessor_s
+	pPool *sessionPool_s
+	key   string
+}
+
+func (a *keepAliveServerProcessor_s) connect(
+	host string,
+	tlsMode string,
+	noSimpleLogin bool,
+	noSASLPlainLogin bool,
+	noSASLExternal bool,
+	username string,
+	getCredentials func() (password string, accessToken string, err error),
+	identity string,
+	auth string,
+	logLevel string,
+	allowPlaintextAuth bool,
+	pDialer *dialer_s,
+	pTLSConfig *tls.Config) (err error) {
+	a.key = host + "\x00" + username
+
+	// imap servers log out idle sessions after a while.  cf. [https://www.rfc-editor.org/rfc/rfc3501#section-5.4]
+	if pSession := a.pPool.take(a.key); pSession != nil {
+		_, noopError := imap.Wait(pSession.pClient.Noop())
+		if noopError == nil {
+			a.serverProcessor_s = pSession
+			return
+		}
+		log.Printf("%s: imap session kept open is lost, connecting again: %v", host, noopError)
+		pSession.logout()
+	}
+
+	err = a.serverProcessor_s.connect(
+		host,
+		tlsMode,
+		noSimpleLogin,
+		noSASLPlainLogin,
+		noSASLExternal,
+		username,
+		getCredentials,
+		identity,
+		auth,
+		logLevel,
+		allowPlaintextAuth,
+		pDialer,
+		pTLSConfig)
+	return
+}
+
+// logout keeps session open for next run of daemon.
+func (a *keepAliveServerProcessor_s) logout() (err error) {
+	err = a.pPool.put(a.key, a.serverProcessor_s)
+	return
+}
+
+// keepAliveConfigProcessor_s implements iConfigProcessor.
+type keepAliveConfigProcessor_s struct {
+	pPool *sessionPool_s
+}
+
+func (a *keepAliveConfigProcessor_s) newServerProcessor() iServerProcessor {
+	return &keepAliveServerProcessor_s{serverProcessor_s: newServerProcessor(), pPool: a.pPool}
+}
+
+// reload_config loads config file again and performs the dry run on it.
+func reload_config(pTLSConfig *tls.Config) (pConfigData *goifo_conf_s, schedule iSchedule, err error) {
+	var configData goifo_conf_s
+	if err = loadConfig(configFile, &configData); err != nil {
+		return
+	}
+
+	if err = checkCommand(&configData, pTLSConfig); err != nil {
+		return
+	}
+
+	schedule, err = new_schedule(&configData)
+	pConfigData = &configData
+
+	return
+}
+
+// daemonCommand performs the dry run and, if it succeeds, processes config file according to
+// interval or cron given there until SIGTERM or SIGINT is received.  Mailboxes having idle set
+// are watched in between.  SIGHUP reloads config file.
+// If the reloaded one is broken, the previous one is kept.
+func daemonCommand(pConfigData *goifo_conf_s, pTLSConfig *tls.Config) (err error) {
+	if err = checkCommand(pConfigData, pTLSConfig); err != nil {
+		return
+	}
+
+	schedule, err := new_schedule(pConfigData)
+	if err != nil {
+		err = &configError{err}
+		return
+	}
+
+	var reloadRequested atomic.Bool
+	wakeup := make(chan struct{}, 1)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGHUP {
+				reloadRequested.Store(true)
+			} else {
+				log.Printf("%v received.  shutting down after current mailbox", sig)
+				stopRequested.Store(true)
+			}
+			select {
+			case wakeup <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	pool := sessionPool_s{}
+	defer pool.logout()
+
+	// mailboxes having idle set are watched by sessions of their own.
+	var watchers sync.WaitGroup
+	stopWatching := make(chan struct{})
+	start_watchers(pConfigData, pTLSConfig, stopWatching, &watchers)
+	defer func() {
+		close(stopWatching)
+		watchers.Wait()
+	}()
+
+	configProcessor := keepAliveConfigProcessor_s{pPool: &pool}
+	next := time.Now()
+
+	for !stopRequested.Load() {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-wakeup:
+		}
+		timer.Stop()
+
+		switch {
+		case stopRequested.Load():
+		case reloadRequested.Swap(false):
+			pNewConfigData, newSchedule, reloadError := reload_config(pTLSConfig)
+			if reloadError != nil {
+				log.Printf("%s: reloading failed, keeping previous config: %v", configFile, reloadError)
+				continue
+			}
+			// sessions and watchers may belong to servers changed or removed.
+			pool.logout()
+			close(stopWatching)
+			watchers.Wait()
+			pConfigData, schedule = pNewConfigData, newSchedule
+			stopWatching = make(chan struct{})
+			start_watchers(pConfigData, pTLSConfig, stopWatching, &watchers)
+			next = schedule.next(time.Now())
+			log.Printf("%s reloaded.  next run at %s", configFile, next.Format(time.DateTime))
+		case !time.Now().Before(next):
+			if runError := process_report(&configProcessor, pConfigData, pTLSConfig); runError != nil {
+				log.Print(runError)
+			}
+			next = schedule.next(time.Now())
+			log.Printf("next run at %s", next.Format(time.DateTime))
+		}
+	}
+
+	return
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestKeepAliveConnectReusesSession(t *testing.T) {
+	pClient, commands := newTestClient(t)
+	pool := sessionPool_s{}
+	pool.put("imap.example.org\x00user", &serverProcessor_s{pClient: pClient, host: "imap.example.org", username: "user"})
+
+	processor := keepAliveServerProcessor_s{serverProcessor_s: newServerProcessor(), pPool: &pool}
+	getCredentials := func() (password string, accessToken string, err error) {
+		t.Error("credentials resolved although session is reused")
+		return
+	}
+	err := processor.connect("imap.example.org", "tls", false, false, false, "user", getCredentials, "", "", "", false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if processor.pClient != pClient {
+		t.Error("session kept in pool is not reused")
+	}
+	if got := receivedCommands(commands); len(got) != 1 || got[0] != "NOOP" {
+		t.Errorf("commands sent = %q, want NOOP", got)
+	}
+}
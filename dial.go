@@ -0,0 +1,274 @@
+package main
+
+// All stuff about establishing network connections to imap servers.
+// Connections are established directly or through a SOCKS5 or HTTP CONNECT proxy.
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultConnectTimeout  = 30 * time.Second // Time to establish a TCP connection if connect_timeout is not given.
+	defaultGreetingTimeout = 60 * time.Second // Time to receive greeting if connect_timeout is not given.
+)
+
+// dialer_s describes how to connect an imap server.
+type dialer_s struct {
+	address         string // host and port of imap server.
+	hostname        string // host of imap server.  Used for verifying its certificate.
+	netDialer       net.Dialer
+	greetingTimeout time.Duration
+	pProxy          *url.URL // nil if imap server is connected directly.
+}
+
+// newDialer creates a dialer_s instance for the server described by pServer.
+// tlsMode selects the default port.
+func newDialer(pServer *server_s, tlsMode string) (pDialer *dialer_s, err error) {
+	pDialer = &dialer_s{
+		netDialer:       net.Dialer{Timeout: defaultConnectTimeout},
+		greetingTimeout: defaultGreetingTimeout}
+
+	hostname, port, splitError := net.SplitHostPort(pServer.Host)
+	switch {
+	case splitError == nil && pServer.Port != 0:
+		err = fmt.Errorf("%s: port given twice", pServer.Host)
+		return
+	case splitError == nil:
+		pDialer.hostname = hostname
+		pDialer.address = net.JoinHostPort(hostname, port)
+	default:
+		pDialer.hostname = pServer.Host
+		switch {
+		case pServer.Port < 0 || pServer.Port > 65535:
+			err = fmt.Errorf("%s: port %d out of range", pServer.Host, pServer.Port)
+			return
+		case pServer.Port != 0:
+			port = strconv.Itoa(pServer.Port)
+		case tlsMode == "implicit":
+			port = "993"
+		default:
+			port = "143"
+		}
+		pDialer.address = net.JoinHostPort(pServer.Host, port)
+	}
+
+	if pServer.ConnectTimeout < 0 {
+		err = fmt.Errorf("%s: connect_timeout must not be negative", pServer.Host)
+		return
+	}
+	if pServer.ConnectTimeout > 0 {
+		pDialer.netDialer.Timeout = pServer.ConnectTimeout
+		pDialer.greetingTimeout = pServer.ConnectTimeout
+	}
+
+	if pServer.LocalAddress != "" {
+		pDialer.netDialer.LocalAddr, err = net.ResolveTCPAddr("tcp", net.JoinHostPort(pServer.LocalAddress, "0"))
+		if err != nil {
+			err = fmt.Errorf("%s: local_address: %w", pServer.Host, err)
+			return
+		}
+	}
+
+	if pServer.Proxy != "" {
+		pDialer.pProxy, err = url.Parse(pServer.Proxy)
+		if err != nil {
+			err = fmt.Errorf("%s: proxy: %w", pServer.Host, err)
+			return
+		}
+		switch {
+		case pDialer.pProxy.Scheme != "socks5" && pDialer.pProxy.Scheme != "http":
+			err = fmt.Errorf("%s: proxy: unknown scheme %s.  admitted are socks5 and http", pServer.Host, pDialer.pProxy.Scheme)
+		case pDialer.pProxy.Port() == "":
+			err = fmt.Errorf("%s: proxy: port missing", pServer.Host)
+		}
+	}
+
+	return
+}
+
+// dial connects the imap server.  If tlsMode is implicit a TLS session is started on this connection.
+func (a *dialer_s) dial(tlsMode string, pTLSConfig *tls.Config) (conn net.Conn, err error) {
+	if a.pProxy == nil {
+		conn, err = a.netDialer.Dial("tcp", a.address)
+	} else {
+		conn, err = a.dialProxy()
+	}
+	if err != nil {
+		return
+	}
+
+	if tlsMode == "implicit" {
+		config := pTLSConfig.Clone()
+		if config.ServerName == "" {
+			config.ServerName = a.hostname
+		}
+		conn = tls.Client(conn, config)
+	}
+
+	return
+}
+
+// dialProxy connects the imap server through a proxy.
+func (a *dialer_s) dialProxy() (conn net.Conn, err error) {
+	conn, err = a.netDialer.Dial("tcp", a.pProxy.Host)
+	if err != nil {
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(a.netDialer.Timeout))
+
+	switch a.pProxy.Scheme {
+	case "socks5":
+		err = a.socks5Connect(conn)
+	case "http":
+		conn, err = a.httpConnect(conn)
+	}
+	if err != nil {
+		conn.Close()
+		err = fmt.Errorf("proxy %s: %w", a.pProxy.Host, err)
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return
+}
+
+// socks5Connect requests a connection to imap server from a SOCKS5 proxy.
+// If proxy url contains user information username/password authentication is offered.
+// cf. [https://www.rfc-editor.org/rfc/rfc1928] and [https://www.rfc-editor.org/rfc/rfc1929]
+func (a *dialer_s) socks5Connect(conn net.Conn) (err error) {
+	methods := []byte{0x00}
+	if a.pProxy.User != nil {
+		methods = []byte{0x00, 0x02}
+	}
+	if _, err = conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return
+	}
+
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return
+	}
+	switch {
+	case reply[0] != 0x05:
+		err = errors.New("socks5: unexpected version")
+		return
+	case reply[1] == 0x02 && a.pProxy.User != nil:
+		username := a.pProxy.User.Username()
+		password, _ := a.pProxy.User.Password()
+		request := []byte{0x01, byte(len(username))}
+		request = append(request, username...)
+		request = append(request, byte(len(password)))
+		request = append(request, password...)
+		if _, err = conn.Write(request); err != nil {
+			return
+		}
+		if _, err = io.ReadFull(conn, reply); err != nil {
+			return
+		}
+		if reply[1] != 0x00 {
+			err = errors.New("socks5: authentication failed")
+			return
+		}
+	case reply[1] != 0x00:
+		err = errors.New("socks5: no acceptable authentication method")
+		return
+	}
+
+	host, portString, _ := net.SplitHostPort(a.address)
+	port, _ := strconv.Atoi(portString)
+	request := []byte{0x05, 0x01, 0x00, 0x03, byte(len(host))}
+	request = append(request, host...)
+	request = append(request, byte(port>>8), byte(port))
+	if _, err = conn.Write(request); err != nil {
+		return
+	}
+
+	// reply consists of version, status, reserved byte, address type, bound address and port.
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return
+	}
+	if header[1] != 0x00 {
+		err = fmt.Errorf("socks5: connect failed with status %d", header[1])
+		return
+	}
+
+	var addressLength int
+	switch header[3] {
+	case 0x01:
+		addressLength = net.IPv4len
+	case 0x04:
+		addressLength = net.IPv6len
+	case 0x03:
+		length := make([]byte, 1)
+		if _, err = io.ReadFull(conn, length); err != nil {
+			return
+		}
+		addressLength = int(length[0])
+	default:
+		err = errors.New("socks5: unknown address type")
+		return
+	}
+	_, err = io.ReadFull(conn, make([]byte, addressLength+2))
+
+	return
+}
+
+// bufferedConn_s is a connection whose first bytes already have been read into a buffer.
+type bufferedConn_s struct {
+	net.Conn
+	pReader *bufio.Reader
+}
+
+func (a *bufferedConn_s) Read(b []byte) (int, error) {
+	return a.pReader.Read(b)
+}
+
+// httpConnect requests a tunnel to imap server from a HTTP proxy by the CONNECT method.
+// If proxy url contains user information basic authentication is used.
+// cf. [https://www.rfc-editor.org/rfc/rfc9110#section-9.3.6]
+func (a *dialer_s) httpConnect(conn net.Conn) (tunnel net.Conn, err error) {
+	tunnel = conn
+
+	pRequest := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: a.address},
+		Host:   a.address,
+		Header: http.Header{}}
+	if a.pProxy.User != nil {
+		password, _ := a.pProxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(a.pProxy.User.Username() + ":" + password))
+		pRequest.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err = pRequest.Write(conn); err != nil {
+		return
+	}
+
+	pReader := bufio.NewReader(conn)
+	pResponse, err := http.ReadResponse(pReader, pRequest)
+	if err != nil {
+		return
+	}
+	pResponse.Body.Close()
+	if pResponse.StatusCode != http.StatusOK {
+		err = fmt.Errorf("http connect: %s", pResponse.Status)
+		return
+	}
+
+	// imap server's greeting may already be buffered.
+	tunnel = &bufferedConn_s{Conn: conn, pReader: pReader}
+
+	return
+}
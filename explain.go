@@ -0,0 +1,179 @@
+package main
+
+// Implements interfaces defined [here](config.go) for printing the search keys
+// each rule produces.  No imap operation is performed.
+
+import (
+	"crypto/tls"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// explainRuleProcessor_s implements iRuleProcessor.
+// It prints search keys and actions of a rule instead of performing them.
+type explainRuleProcessor_s struct {
+	accu   []string // search keys gathered for the imap's SEARCH command.
+	prefix string   // server, mailbox and rule number used for labelling output.
+	trash  string   // name of trash mailbox.
+}
+
+func (a *explainRuleProcessor_s) append(s string) {
+	a.accu = append(a.accu, s)
+}
+
+func (a *explainRuleProcessor_s) appendRegex(header string, pRegexp *regexp.Regexp, isNegated bool) {
+	if header == "" {
+		a.accu = append(a.accu, fmt.Sprintf("<body matching /%s/>", pRegexp))
+	} else {
+		a.accu = append(a.accu, fmt.Sprintf("<%s matching /%s/>", header, pRegexp))
+	}
+}
+
+func (a *explainRuleProcessor_s) search() (err error) {
+	keys := a.accu
+	if len(keys) == 0 {
+		keys = []string{"ALL"}
+	}
+	fmt.Printf("%s: UID SEARCH %s\n", a.prefix, strings.Join(keys, " "))
+	return
+}
+
+func (a *explainRuleProcessor_s) countMatches() (nrMatches uint32, nrEmails uint32) {
+	return
+}
+
+func (a *explainRuleProcessor_s) copy(dest string) (err error) {
+	fmt.Printf("%s: UID COPY to %s\n", a.prefix, dest)
+	return
+}
+
+func (a *explainRuleProcessor_s) move(dest string) (err error) {
+	fmt.Printf("%s: UID COPY to %s\n", a.prefix, dest)
+	return
+}
+
+func (a *explainRuleProcessor_s) markSrcForDel() (err error) {
+	fmt.Printf("%s: UID STORE +FLAGS \\Deleted\n", a.prefix)
+	return
+}
+
+func (a *explainRuleProcessor_s) moveToTrash() (err error) {
+	fmt.Printf("%s: UID COPY to %s\n", a.prefix, a.trash)
+	return
+}
+
+func (a *explainRuleProcessor_s) flag(flags []string) (err error) {
+	fmt.Printf("%s: UID STORE +FLAGS (%s)\n", a.prefix, strings.Join(flags, " "))
+	return
+}
+
+func (a *explainRuleProcessor_s) unflag(flags []string) (err error) {
+	fmt.Printf("%s: UID STORE -FLAGS (%s)\n", a.prefix, strings.Join(flags, " "))
+	return
+}
+
+// restrictToNew adds a placeholder since UIDs examined by former runs are not looked up.
+func (a *explainRuleProcessor_s) restrictToNew(digest string) (err error) {
+	a.accu = append(a.accu, "UID <last examined + 1>:<highest UID>")
+	return
+}
+
+// restrictToChanged adds nothing since it depends on CONDSTORE support of imap server and on former runs.
+func (a *explainRuleProcessor_s) restrictToChanged(digest string) {
+}
+
+func (a *explainRuleProcessor_s) classify(err error) error {
+	return err
+}
+
+// explainMailboxProcessor_s implements iMailboxProcessor.
+type explainMailboxProcessor_s struct {
+	host   string
+	name   string
+	trash  string
+	nrRule int // number of rules processed so far.
+}
+
+func (a *explainMailboxProcessor_s) selectMailbox(name string) (err error) {
+	a.name = name
+	return
+}
+
+func (a *explainMailboxProcessor_s) newRuleProcessor() iRuleProcessor {
+	a.nrRule++
+	return &explainRuleProcessor_s{
+		prefix: fmt.Sprintf("%s/%s rule #%d", a.host, a.name, a.nrRule),
+		trash:  a.trash}
+}
+
+func (a *explainMailboxProcessor_s) reopen() (err error) {
+	return
+}
+
+func (a *explainMailboxProcessor_s) close() (err error) {
+	return
+}
+
+func (a *explainMailboxProcessor_s) commit() (err error) {
+	return
+}
+
+// explainServerProcessor_s implements iServerProcessor.
+type explainServerProcessor_s struct {
+	host  string
+	trash string
+}
+
+func (a *explainServerProcessor_s) connect(
+	host string,
+	tlsMode string,
+	noSimpleLogin bool,
+	noSASLPlainLogin bool,
+	noSASLExternal bool,
+	username string,
+	getCredentials func() (password string, accessToken string, err error),
+	identity string,
+	auth string,
+	logLevel string,
+	allowPlaintextAuth bool,
+	pDialer *dialer_s,
+	pTLSConfig *tls.Config) (err error) {
+	a.host = host
+	return
+}
+
+// getAccessToken does not contact any token endpoint.
+func (a *explainServerProcessor_s) getAccessToken(host string, username string, pOAuth2 *oauth2_s) (accessToken string, err error) {
+	return
+}
+
+// getPassword neither runs password_command nor reads password_file.
+func (a *explainServerProcessor_s) getPassword(pServer *server_s) (password string, err error) {
+	return
+}
+
+// setTrash remembers trash mailbox.  Detecting it requires an imap session, so it is just labelled here.
+func (a *explainServerProcessor_s) setTrash(name string) (err error) {
+	a.trash = name
+	if a.trash == "" {
+		a.trash = "mailbox having \\Trash attribute"
+	}
+	return
+}
+
+func (a *explainServerProcessor_s) newMailboxProcessor() iMailboxProcessor {
+	return &explainMailboxProcessor_s{host: a.host, trash: a.trash}
+}
+
+func (a *explainServerProcessor_s) logout() (err error) {
+	return
+}
+
+// explainConfigProcessor_s implements iConfigProcessor.
+type explainConfigProcessor_s struct {
+}
+
+func (a *explainConfigProcessor_s) newServerProcessor() iServerProcessor {
+	return &explainServerProcessor_s{}
+}
@@ -0,0 +1,296 @@
+package main
+
+// All stuff about watching mailboxes by imap's IDLE command so that rules are applied
+// to emails as soon as they arrive.  Mailboxes are polled by imap's NOOP command if
+// imap server does not support IDLE.
+// cf. [https://www.rfc-editor.org/rfc/rfc2177]
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+const (
+	idleRenewal   = 29 * time.Minute // imap servers may log out clients idling for 30 minutes.
+	pollInterval  = time.Minute      // delay between NOOP commands if imap server does not support IDLE.
+	stopCheckTime = time.Second      // how long watching waits for responses before checking whether it has to stop.
+)
+
+// arrivalsMailboxProcessor_s implements iMailboxProcessor.
+// Rules are restricted to emails which arrived while watching.
+type arrivalsMailboxProcessor_s struct {
+	*mailboxProcessor_s
+	pUIDs *imap.SeqSet // UIDs of emails arrived.
+}
+
+// commit remembers nothing since emails arrived before watching started were not examined.
+func (a *arrivalsMailboxProcessor_s) commit() (err error) {
+	return
+}
+
+func (a *arrivalsMailboxProcessor_s) newRuleProcessor() iRuleProcessor {
+	processor := a.mailboxProcessor_s.newRuleProcessor()
+	processor.append("UID")
+	processor.append(a.pUIDs.String())
+	return processor
+}
+
+// mailboxLocks keeps a *sync.Mutex for each mailbox by host, username and name of mailbox.
+var mailboxLocks sync.Map
+
+// lock_mailbox keeps scheduled runs and watchers from applying rules to a mailbox at the same
+// time since both would e.g. copy the same emails.  unlock has to be called after processing.
+func lock_mailbox(pServer *server_s, pMailbox *mailbox_s) (unlock func()) {
+	value, _ := mailboxLocks.LoadOrStore(pServer.Host+"\x00"+pServer.Username+"\x00"+pMailbox.Name, &sync.Mutex{})
+	pMutex := value.(*sync.Mutex)
+	pMutex.Lock()
+	unlock = pMutex.Unlock
+	return
+}
+
+// watcher_s watches a mailbox having idle set in config file.
+type watcher_s struct {
+	pServer    *server_s
+	pMailbox   *mailbox_s
+	pTLSConfig *tls.Config
+	limit      maxMatches_s  // upper bound of emails a rule may match inherited from server.
+	retry      retry_s       // retrying rules and delays between connecting again.
+	stop       chan struct{} // closed if watching has to stop.
+	label      string        // server and mailbox used for labelling log output.
+	nextUID    uint32        // emails having this UID or a higher one are not processed yet.  0 if unknown.
+}
+
+// start_watchers starts watching each mailbox having idle set in config file given by pConfigData.
+// Watching stops if stop is closed.  pWaitGroup is done when all watchers stopped.
+func start_watchers(pConfigData *goifo_conf_s, pTLSConfig *tls.Config, stop chan struct{}, pWaitGroup *sync.WaitGroup) {
+	for i := range pConfigData.Servers {
+		pServer := &pConfigData.Servers[i]
+
+		// settings were checked by the dry run already.
+		limit, _ := process_max_matches(&pServer.MaxMatches, maxMatches_s{})
+		retry, _ := retry_policy(pServer)
+
+		for j := range pServer.Mailboxes {
+			pMailbox := &pServer.Mailboxes[j]
+			if !pMailbox.Idle {
+				continue
+			}
+
+			pWatcher := &watcher_s{
+				pServer:    pServer,
+				pMailbox:   pMailbox,
+				pTLSConfig: pTLSConfig,
+				limit:      limit,
+				retry:      retry,
+				stop:       stop,
+				label:      fmt.Sprintf("%s/%s", pServer.Host, pMailbox.Name)}
+
+			pWaitGroup.Add(1)
+			go func() {
+				defer pWaitGroup.Done()
+				pWatcher.watch()
+			}()
+		}
+	}
+}
+
+// isStopped checks whether watching has to stop.
+func (a *watcher_s) isStopped() bool {
+	select {
+	case <-a.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// watch connects imap server and watches mailbox until watching has to stop.
+// If connection is lost imap server is connected again after a delay growing with each failure.
+// The delay is reset only if mailbox was watched, not if e.g. it cannot be selected.
+func (a *watcher_s) watch() {
+	for attempt := 0; !a.isStopped(); attempt++ {
+		isWatched, err := a.session()
+		if a.isStopped() {
+			return
+		}
+		if isWatched {
+			attempt = 0
+		}
+
+		delay := a.retry.backoff(attempt)
+		log.Printf("%s: watching failed: %v.  connecting again in %s", a.label, err, delay)
+		select {
+		case <-a.stop:
+		case <-time.After(delay):
+		}
+	}
+}
+
+// session connects imap server and applies rules to emails arriving in mailbox until
+// watching has to stop or an error occurs.  isWatched tells whether imap server accepted
+// IDLE or NOOP at least once.
+func (a *watcher_s) session() (isWatched bool, err error) {
+	processor := newServerProcessor()
+	err = connect_server(processor, a.pServer, a.pTLSConfig)
+	if err != nil {
+		return
+	}
+
+	defer processor.logout()
+
+	err = processor.setTrash(a.pServer.Trash)
+	if err != nil {
+		return
+	}
+
+	for !a.isStopped() {
+		var pUIDs *imap.SeqSet
+		pUIDs, err = a.arrivals(processor.pClient)
+		if err != nil {
+			return
+		}
+
+		if !pUIDs.Empty() {
+			log.Printf("%s: emails arrived: %s", a.label, pUIDs)
+			unlock := lock_mailbox(a.pServer, a.pMailbox)
+			mailboxError := process_mailbox(
+				&arrivalsMailboxProcessor_s{newMailboxProcessor(processor), pUIDs},
+				a.pMailbox,
+				a.limit,
+				a.retry)
+			unlock()
+			if mailboxError != nil {
+				log.Printf("%s: %v", a.label, mailboxError)
+			}
+			// look for emails arrived while processing rules.
+			continue
+		}
+
+		var isWaited bool
+		isWaited, err = a.wait(processor.pClient)
+		isWatched = isWatched || isWaited
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// arrivals selects mailbox and returns the UIDs of emails not processed yet.
+// On first call no email is considered new.
+func (a *watcher_s) arrivals(pClient *imap.Client) (pUIDs *imap.SeqSet, err error) {
+	pUIDs, _ = imap.NewSeqSet("")
+
+	// watch backs off if mailbox cannot be selected.
+	_, err = select_mailbox(pClient, a.pMailbox.Name, false)
+	if err != nil {
+		return
+	}
+
+	if a.nextUID == 0 && pClient.Mailbox.UIDNext != 0 {
+		a.nextUID = pClient.Mailbox.UIDNext
+		return
+	}
+
+	// UID n:* matches the email having the highest UID even if it is lower than n.
+	var cmd *imap.Command
+	if a.nextUID == 0 {
+		cmd, err = imap.Wait(pClient.UIDSearch("ALL"))
+	} else {
+		cmd, err = imap.Wait(pClient.UIDSearch("UID", fmt.Sprintf("%d:*", a.nextUID)))
+	}
+	if err != nil {
+		return
+	}
+
+	isFirst, fromUID := a.nextUID == 0, a.nextUID
+	for _, rsp := range cmd.Data {
+		for _, uid := range search_results(rsp) {
+			if uid < fromUID {
+				continue
+			}
+			if !isFirst {
+				pUIDs.AddNum(uid)
+			}
+			if uid >= a.nextUID {
+				a.nextUID = uid + 1
+			}
+		}
+	}
+	if a.nextUID == 0 {
+		a.nextUID = 1
+	}
+
+	return
+}
+
+// wait waits until imap server reports that the number of emails in mailbox increased
+// or watching has to stop.  IDLE is renewed after a while.  If imap server does not
+// support IDLE it is polled by NOOP.  isWaited tells whether imap server accepted IDLE or NOOP.
+func (a *watcher_s) wait(pClient *imap.Client) (isWaited bool, err error) {
+	nrEmails := pClient.Mailbox.Messages
+	pClient.Data = nil
+
+	// isIncreased checks responses received for EXISTS exceeding the number of emails.
+	isIncreased := func() (retval bool) {
+		for _, rsp := range pClient.Data {
+			switch rsp.Label {
+			case "EXISTS":
+				retval = retval || rsp.Value() > nrEmails
+				nrEmails = rsp.Value()
+			case "EXPUNGE":
+				nrEmails--
+			}
+		}
+		pClient.Data = nil
+		return
+	}
+
+	if !pClient.Caps["IDLE"] {
+		for {
+			select {
+			case <-a.stop:
+				return
+			case <-time.After(pollInterval):
+			}
+
+			_, err = imap.Wait(pClient.Noop())
+			if err != nil {
+				return
+			}
+			isWaited = true
+			if isIncreased() {
+				return
+			}
+		}
+	}
+
+	_, err = pClient.Idle()
+	if err != nil {
+		return
+	}
+	isWaited = true
+
+	for renewal := time.Now().Add(idleRenewal); time.Now().Before(renewal) && !a.isStopped(); {
+		err = pClient.Recv(stopCheckTime)
+		if err == imap.ErrTimeout {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if isIncreased() {
+			break
+		}
+	}
+
+	_, err = pClient.IdleTerm()
+
+	return
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArrivals(t *testing.T) {
+	tests := []struct {
+		name      string
+		mailbox   string
+		nextUID   uint32
+		search    string
+		want      string
+		wantError bool
+	}{
+		{name: "first call", mailbox: "INBOX", want: ""},
+		{name: "emails arrived", mailbox: "INBOX", nextUID: 150, search: "* SEARCH 150 199", want: "150,199"},
+		{name: "no email arrived", mailbox: "INBOX", nextUID: 200, search: "* SEARCH 199", want: ""},
+		{name: "mailbox not selectable", mailbox: "Missing", nextUID: 150, wantError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pClient, _ := newTestClient(t,
+				testReply_s{"UID SEARCH", []string{test.search}},
+				testReply_s{`SELECT "Missing"`, []string{"TAG NO no such mailbox"}})
+			watcher := watcher_s{pMailbox: &mailbox_s{Name: test.mailbox}, nextUID: test.nextUID}
+
+			pUIDs, err := watcher.arrivals(pClient)
+			if (err != nil) != test.wantError {
+				t.Fatalf("arrivals() error = %v, want error %v", err, test.wantError)
+			}
+			if err == nil && pUIDs.String() != test.want {
+				t.Errorf("arrivals() = %q, want %q", pUIDs, test.want)
+			}
+		})
+	}
+}
+
+// logLines_s receives lines logged.
+type logLines_s struct {
+	lines chan string
+}
+
+func (a logLines_s) Write(p []byte) (n int, err error) {
+	select {
+	case a.lines <- string(p):
+	default:
+	}
+	return len(p), nil
+}
+
+func TestWatchBacksOff(t *testing.T) {
+	address, connections, _ := newTestServer(t, testReply_s{`SELECT "Missing"`, []string{"TAG NO no such mailbox"}})
+
+	logged := logLines_s{make(chan string, 100)}
+	log.SetOutput(logged)
+	defer log.SetOutput(os.Stderr)
+
+	watcher := watcher_s{
+		pServer: &server_s{
+			Host:           address,
+			TLS:            "none",
+			AllowPlainAuth: true,
+			NoSASLExternal: true,
+			Username:       "user",
+			Password:       "password",
+			Trash:          "Trash"},
+		pMailbox:   &mailbox_s{Name: "Missing"},
+		pTLSConfig: &tls.Config{},
+		retry:      retry_s{delay: 10 * time.Millisecond, maxDelay: time.Second},
+		stop:       make(chan struct{}),
+		label:      "test"}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		watcher.watch()
+	}()
+
+	var delays []time.Duration
+	for len(delays) < 5 {
+		select {
+		case line := <-logged.lines:
+			_, delayExpr, isDelay := strings.Cut(strings.TrimSpace(line), "connecting again in ")
+			if !isDelay {
+				continue
+			}
+			delay, err := time.ParseDuration(delayExpr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			delays = append(delays, delay)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("watching did not fail repeatedly.  delays: %v", delays)
+		}
+	}
+	close(watcher.stop)
+	<-done
+
+	// delays are jittered by up to a half, i.e. the one of attempt i lies between 2^(i-1) and 2^i times retry_delay.
+	for i := 1; i < len(delays); i++ {
+		if delays[i] < delays[i-1] {
+			t.Errorf("delays do not grow: %v", delays)
+			break
+		}
+	}
+	if last := delays[len(delays)-1]; last < 8*watcher.retry.delay {
+		t.Errorf("delay after %d failures = %s, want at least %s", len(delays), last, 8*watcher.retry.delay)
+	}
+	if len(connections) < len(delays) {
+		t.Errorf("%d connections for %d failures", len(connections), len(delays))
+	}
+}
+
+func TestLockMailbox(t *testing.T) {
+	pServer := &server_s{Host: "imap.example.org", Username: "user"}
+	unlock := lock_mailbox(pServer, &mailbox_s{Name: "INBOX"})
+
+	// other mailboxes are not locked.
+	lock_mailbox(pServer, &mailbox_s{Name: "Archive"})()
+
+	locked := make(chan struct{})
+	go func() {
+		lock_mailbox(pServer, &mailbox_s{Name: "INBOX"})()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("mailbox locked twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("mailbox not locked after unlocking")
+	}
+}
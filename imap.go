@@ -6,7 +6,9 @@ package main
 import (
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"log"
+	"strconv"
 
 	"github.com/mxk/go-imap/imap"
 )
@@ -14,16 +16,29 @@ import (
 // ruleProcessor_s implements iRuleProcessor
 // Processing preconditions of rules we execute a SEARCH command on imap server.
 type ruleProcessor_s struct {
-	accu           []imap.Field // for gathering search keys used in imap's SEARCH command. cf. [https://pkg.go.dev/github.com/mxk/go-imap/imap#Client.Search]
-	pClient        *imap.Client // handle for imap network connection.
-	pSearchResults *imap.SeqSet // Search results appeare here.
+	accu            []imap.Field  // for gathering search keys used in imap's SEARCH command. cf. [https://pkg.go.dev/github.com/mxk/go-imap/imap#Client.Search]
+	pClient         *imap.Client  // handle for imap network connection.
+	pSearchResults  *imap.SeqSet  // Search results appeare here.  They are UIDs, not sequence numbers.
+	nrSearchResults int           // number of emails in pSearchResults.
+	pendingDest     string        // destination of a move which is postponed until markSrcForDel is called.
+	pDeletedUIDs    *imap.SeqSet  // UIDs of emails marked as deleted in this mailbox.  Shared with mailboxProcessor_s.
+	mailbox         string        // name of mailbox selected.
+	trash           string        // name of trash mailbox.  Empty if unknown.
+	nrRegexKeys     int           // number of search keys in accu matched locally.  cf. [regex.go]
+	pTracker        *uidTracker_s // tells which emails were examined by former runs.  cf. [state.go]
+	isUnchanged     bool          // search is skipped since no email changed after rule succeeded on them.
+	isNothingNew    bool          // search is skipped since no email arrived after incremental rule examined emails.
+	isCopySent      bool          // COPY or MOVE was sent.  Retrying would copy emails twice.
 }
 
 // newRuleProcessor creates a ruleProcessor_s instance.
-func newRuleProcessor(pClient *imap.Client) (retval *ruleProcessor_s) {
+func newRuleProcessor(pClient *imap.Client, pDeletedUIDs *imap.SeqSet, mailbox string, trash string) (retval *ruleProcessor_s) {
 	retval = &ruleProcessor_s{
-		accu:    []imap.Field{},
-		pClient: pClient}
+		accu:         []imap.Field{},
+		pClient:      pClient,
+		pDeletedUIDs: pDeletedUIDs,
+		mailbox:      mailbox,
+		trash:        trash}
 	retval.pSearchResults, _ = imap.NewSeqSet("")
 	return
 }
@@ -33,14 +48,92 @@ func (a *ruleProcessor_s) append(s string) {
 	(*a).accu = append((*a).accu, s)
 }
 
-// search performs SEARCH command.
+// search_results returns the UIDs or sequence numbers of a SEARCH response.  Unlike go-imap's
+// SearchResults it skips anything else, e.g. (MODSEQ n) appended if search keys contain MODSEQ,
+// which go-imap turns into 0, i.e. *.
+// cf. [https://www.rfc-editor.org/rfc/rfc7162#section-3.1.5]
+func search_results(rsp *imap.Response) (retval []uint32) {
+	if rsp.Label != "SEARCH" {
+		return
+	}
+
+	for _, field := range rsp.Fields[1:] {
+		if imap.TypeOf(field) == imap.Number {
+			retval = append(retval, imap.AsNumber(field))
+		}
+	}
+
+	return
+}
+
+// restrictToNew restricts search to emails the incremental rule given by digest did not examine
+// on former run.  Search is bounded by the highest UID present now, which is remembered as examined.
+// Emails arriving meanwhile are left to next run.
+func (a *ruleProcessor_s) restrictToNew(digest string) (err error) {
+	cmd, err := imap.Wait(a.pClient.UIDSearch("UID", "*"))
+	if err != nil {
+		return
+	}
+
+	var lastUID uint32
+	for _, rsp := range cmd.Data {
+		for _, uid := range search_results(rsp) {
+			if uid > lastUID {
+				lastUID = uid
+			}
+		}
+	}
+
+	// UID n:m matches the same emails as UID m:n.
+	nextUID := a.pTracker.nextUID(digest)
+	if lastUID < nextUID {
+		a.isNothingNew = true
+		lastUID = nextUID - 1
+	} else {
+		a.append("UID")
+		a.append(fmt.Sprintf("%d:%d", nextUID, lastUID))
+	}
+	a.pTracker.searched(digest, lastUID)
+
+	return
+}
+
+// restrictToChanged restricts search to emails whose MODSEQ changed since the rule given by
+// digest succeeded on former run.  If no email changed at all search is skipped.
+func (a *ruleProcessor_s) restrictToChanged(digest string) {
+	changedSince := a.pTracker.examine(digest)
+	switch {
+	case changedSince == 0:
+	case a.pTracker.isUnchanged():
+		a.isUnchanged = true
+	default:
+		a.append("MODSEQ")
+		a.append(strconv.FormatUint(changedSince+1, 10))
+	}
+}
+
+// search performs UID SEARCH command.
+// UIDs are used instead of sequence numbers because sequence numbers shift if another
+// imap client expunges emails while goifo is running.
 func (a *ruleProcessor_s) search() (err error) {
 	var cmd *imap.Command
 
-	if len(a.accu) == 0 {
-		cmd, err = imap.Wait(a.pClient.Search("ALL"))
+	if a.isUnchanged || a.isNothingNew {
+		return
+	}
+
+	spec := a.accu
+	if a.nrRegexKeys > 0 {
+		spec, err = a.resolveRegexKeys()
+		if err != nil || spec == nil {
+			return
+		}
+	}
+
+	if len(spec) == 0 {
+		cmd, err = imap.Wait(a.pClient.UIDSearch("ALL"))
 	} else {
-		cmd, err = imap.Wait(a.pClient.Search(a.accu...))
+		cmd, err = imap.Wait(a.pClient.UIDSearch(spec...))
 	}
 
 	if err != nil {
@@ -48,64 +141,228 @@ func (a *ruleProcessor_s) search() (err error) {
 	}
 
 	for _, rsp := range cmd.Data {
-		a.pSearchResults.AddNum(rsp.SearchResults()...)
+		for _, uid := range search_results(rsp) {
+			a.pSearchResults.AddNum(uid)
+			a.nrSearchResults++
+		}
+	}
+
+	return
+}
+
+// countMatches returns the number of emails found by search and the number of emails in mailbox
+// as reported by imap server on selecting mailbox.
+func (a *ruleProcessor_s) countMatches() (nrMatches uint32, nrEmails uint32) {
+	nrMatches = uint32(a.nrSearchResults)
+	if a.pClient.Mailbox != nil {
+		nrEmails = a.pClient.Mailbox.Messages
+	}
+	return
+}
+
+// copy performs a copy action instructed by a rule.
+func (a *ruleProcessor_s) copy(dest string) (err error) {
+	if !a.pSearchResults.Empty() {
+		a.isCopySent = true
+		_, err = imap.Wait(a.pClient.UIDCopy(a.pSearchResults, dest))
 	}
 
 	return
 }
 
 // move performs a copy action which is part of performing move instructed by a rule.
+// If imap server supports MOVE command the last destination is not copied but remembered
+// so that markSrcForDel is able to move emails there.
 func (a *ruleProcessor_s) move(dest string) (err error) {
-	if !a.pSearchResults.Empty() {
-		_, err = imap.Wait(a.pClient.Copy(a.pSearchResults, dest))
+	if a.pSearchResults.Empty() {
+		return
+	}
+
+	if !a.pClient.Caps["MOVE"] {
+		err = a.copy(dest)
+		return
+	}
+
+	if a.pendingDest != "" {
+		err = a.copy(a.pendingDest)
 		if err != nil {
 			return
 		}
 	}
+	a.pendingDest = dest
 
 	return
 }
 
 // markSrcForDel marks emails which were moved so that they can be deleted after closing mailbox.
 // It is part of performing move instruction by a rule.
+// If a move to a destination is postponed by move func, emails are moved there by imap's MOVE
+// command instead.
 func (a *ruleProcessor_s) markSrcForDel() (err error) {
+	if a.pSearchResults.Empty() {
+		return
+	}
+
+	if a.pendingDest != "" {
+		a.isCopySent = true
+		_, err = imap.Wait(a.pClient.Send("UID MOVE", a.pSearchResults, a.pClient.Quote(imap.UTF7Encode(a.pendingDest))))
+		a.pendingDest = ""
+		return
+	}
+
+	_, err = imap.Wait(a.pClient.UIDStore(a.pSearchResults, "+FLAGS.SILENT", imap.NewFlagSet("\\Deleted")))
+	if err != nil {
+		return
+	}
+
+	a.pDeletedUIDs.AddSet(a.pSearchResults)
+
+	return
+}
+
+// moveToTrash performs the copy part of moving emails found to trash mailbox.
+// markSrcForDel completes it.
+func (a *ruleProcessor_s) moveToTrash() (err error) {
+	if a.trash == "" {
+		err = errors.New("no trash mailbox known.  set trash in config file or use delete: permanent")
+		return
+	}
+	if a.mailbox == a.trash {
+		err = fmt.Errorf("emails in trash mailbox %s can be deleted by delete: permanent only", a.trash)
+		return
+	}
+
+	err = a.move(a.trash)
+
+	return
+}
+
+// flag sets flags and keywords on emails found.
+func (a *ruleProcessor_s) flag(flags []string) (err error) {
+	if !a.pSearchResults.Empty() {
+		_, err = imap.Wait(a.pClient.UIDStore(a.pSearchResults, "+FLAGS.SILENT", imap.NewFlagSet(flags...)))
+	}
+
+	return
+}
+
+// unflag clears flags and keywords on emails found.
+func (a *ruleProcessor_s) unflag(flags []string) (err error) {
 	if !a.pSearchResults.Empty() {
-		_, err = imap.Wait(a.pClient.Store(a.pSearchResults, "+FLAGS.SILENT", imap.NewFlagSet("\\Deleted")))
+		_, err = imap.Wait(a.pClient.UIDStore(a.pSearchResults, "-FLAGS.SILENT", imap.NewFlagSet(flags...)))
 	}
 
 	return
 }
 
+// classify marks err as permanent if COPY or MOVE was sent since emails must not be copied
+// twice.  Otherwise it is marked as transient if the connection to imap server is closed,
+// e.g. since imap server logged out an idle session.
+func (a *ruleProcessor_s) classify(err error) error {
+	switch {
+	case err == nil:
+	case a.isCopySent:
+		err = permanentError{err}
+	case a.pClient.State() == imap.Closed:
+		err = connectionLostError{err}
+	}
+	return err
+}
+
+// select_mailbox performs imap's SELECT command or, if readonly, EXAMINE.  Unlike go-imap's
+// Select it fails if imap server refuses selecting mailbox, e.g. since it does not exist.
+// pClient.Mailbox is set unless it fails.
+func select_mailbox(pClient *imap.Client, name string, readonly bool) (cmd *imap.Command, err error) {
+	cmd, err = pClient.Select(name, readonly)
+	if err == nil && pClient.Mailbox == nil {
+		if _, err = cmd.Result(imap.OK); err == nil {
+			err = fmt.Errorf("mailbox %s is not selected", name)
+		}
+	}
+	return
+}
+
 // mailboxProcessor_s implements iMailboxProcessor.
 type mailboxProcessor_s struct {
-	pClient *imap.Client
+	pServer      *serverProcessor_s // for reconnecting.
+	pClient      *imap.Client
+	pDeletedUIDs *imap.SeqSet  // UIDs of emails marked as deleted by goifo.
+	pTracker     *uidTracker_s // tells which emails are new or changed since former runs.
+	name         string        // name of mailbox selected.
+	trash        string        // name of trash mailbox.  Empty if unknown.
 }
 
 // newMailboxProcessor creates a mailboxProcess_s instance.
-func newMailboxProcessor(pClient *imap.Client) (retval *mailboxProcessor_s) {
-	retval = &mailboxProcessor_s{pClient: pClient}
+func newMailboxProcessor(pServer *serverProcessor_s) (retval *mailboxProcessor_s) {
+	retval = &mailboxProcessor_s{pServer: pServer, pClient: pServer.pClient, trash: pServer.trash}
+	retval.pDeletedUIDs, _ = imap.NewSeqSet("")
 	return
 }
 
 // selectMailbox performs the SELECT command which starts working with a mailbox in a imap session.
+// UIDs of emails present and HIGHESTMODSEQ now are remembered on first selection.
 func (a *mailboxProcessor_s) selectMailbox(name string) (err error) {
-	_, err = a.pClient.Select(name, false)
+	a.name = name
+	cmd, err := select_mailbox(a.pClient, name, false)
+	if err == nil && a.pTracker == nil {
+		a.pTracker = newUIDTracker(a.pServer.host, a.pServer.username, name, a.pClient.Mailbox, highestModSeq(cmd))
+	}
+	return
+}
+
+// reopen reconnects imap server and selects mailbox again.
+// Emails marked as deleted before are still expunged on closing mailbox.
+func (a *mailboxProcessor_s) reopen() (err error) {
+	err = a.pServer.reconnect()
+	if err != nil {
+		return
+	}
+
+	a.pClient = a.pServer.pClient
+	err = a.selectMailbox(a.name)
+
 	return
 }
 
 func (a *mailboxProcessor_s) newRuleProcessor() iRuleProcessor {
-	return newRuleProcessor(a.pClient)
+	processor := newRuleProcessor(a.pClient, a.pDeletedUIDs, a.name, a.trash)
+	processor.pTracker = a.pTracker
+	return processor
+}
+
+// commit remembers UIDVALIDITY, the highest UID of emails examined and HIGHESTMODSEQ.
+func (a *mailboxProcessor_s) commit() (err error) {
+	err = a.pTracker.commit()
+	return
 }
 
 // close closes a mailbox and expunge emails marked as deleted by effect of aforementioned marSrcForDel func.
+// If imap server supports UIDPLUS only emails marked by goifo are expunged by imap's UID EXPUNGE command.
+// Emails marked as deleted by someone else are kept.
 func (a *mailboxProcessor_s) close() (err error) {
-	_, err = a.pClient.Close(true)
+	if !a.pClient.Caps["UIDPLUS"] {
+		_, err = a.pClient.Close(true)
+		return
+	}
+
+	if !a.pDeletedUIDs.Empty() {
+		_, err = imap.Wait(a.pClient.Expunge(a.pDeletedUIDs))
+		if err != nil {
+			return
+		}
+	}
+
+	_, err = a.pClient.Close(false)
 	return
 }
 
 // serverProcessor_s implements iServerProcessor.
 type serverProcessor_s struct {
-	pClient *imap.Client
+	pClient  *imap.Client
+	host     string
+	username string
+	trash    string       // name of trash mailbox.  Empty if unknown.
+	redial   func() error // connects imap server again the way connect did.
 }
 
 // newServerProcessor creates a serverProcessor_s instance.
@@ -117,60 +374,222 @@ func newServerProcessor() (retval *serverProcessor_s) {
 // connect starts a session on an imap server and performs authentication.
 func (a *serverProcessor_s) connect(
 	host string,
-	noTLS bool,
+	tlsMode string,
 	noSimpleLogin bool,
 	noSASLPlainLogin bool,
 	noSASLExternal bool,
 	username string,
-	password string,
+	getCredentials func() (password string, accessToken string, err error),
 	identity string,
+	auth string,
+	logLevel string,
+	allowPlaintextAuth bool,
+	pDialer *dialer_s,
 	pTLSConfig *tls.Config) (err error) {
-	if noTLS {
-		a.pClient, err = imap.Dial(host)
-	} else {
-		a.pClient, err = imap.DialTLS(host, pTLSConfig)
+	a.host = host
+	a.username = username
+	a.redial = func() error {
+		return a.connect(
+			host,
+			tlsMode,
+			noSimpleLogin,
+			noSASLPlainLogin,
+			noSASLExternal,
+			username,
+			getCredentials,
+			identity,
+			auth,
+			logLevel,
+			allowPlaintextAuth,
+			pDialer,
+			pTLSConfig)
 	}
+
+	password, accessToken, err := getCredentials()
 	if err != nil {
 		return
 	}
 
-	a.pClient.SetLogMask(imap.LogRaw)
+	if tlsMode != "none" && pTLSConfig.InsecureSkipVerify {
+		log.Printf("WARNING: %s: certificate of imap server is NOT verified because of tls_insecure_skip_verify.  use it for test servers only", host)
+	}
 
-	if a.pClient.Caps["STARTTLS"] {
-		_, err = a.pClient.StartTLS(nil)
+	conn, err := pDialer.dial(tlsMode, pTLSConfig)
+	if err != nil {
+		return
 	}
+
+	a.pClient, err = imap.NewClient(conn, pDialer.hostname, pDialer.greetingTimeout)
 	if err != nil {
+		conn.Close()
 		return
 	}
 
+	// do not leave half-open sessions behind, e.g. when connect is retried.
+	defer func() {
+		if err != nil {
+			a.pClient.Logout(logoutTimeout)
+		}
+	}()
+
+	mask, _ := logMask(logLevel)
+	a.pClient.SetLogger(log.New(&logRedactor_s{pLogger: imap.DefaultLogger, host: host}, "", 0))
+	a.pClient.SetLogMask(mask)
+
+	// go-imap does not know imap's MOVE command.  cf. [https://www.rfc-editor.org/rfc/rfc6851]
+	a.pClient.CommandConfig["UID MOVE"] = &imap.CommandConfig{States: imap.Selected}
+
+	if tlsMode == "starttls" {
+		if !a.pClient.Caps["STARTTLS"] {
+			err = errors.New("imap server does not offer STARTTLS.  refusing to continue unencrypted")
+			return
+		}
+		_, err = a.pClient.StartTLS(pTLSConfig)
+		if err != nil {
+			return
+		}
+	}
+
+	// credentials are not sent in clear unless explicitly admitted.
+	isCredentialAuthAdmitted := tlsMode != "none" || allowPlaintextAuth
+	if !isCredentialAuthAdmitted {
+		log.Printf("%s: connection is unencrypted.  authentication by password or token refused.  set allow_plaintext_auth to override", host)
+	}
+
+	// failures of authentication methods are logged.  If a failure is transient,
+	// e.g. imap server responds UNAVAILABLE, the final error tells so.
+	var transientError error
+	authFailed := func(method string, authError error) {
+		log.Printf("%s: %s %v", host, method, authError)
+		if is_transient(authError) {
+			transientError = authError
+		}
+	}
+
+	switch {
+	case !isCredentialAuthAdmitted:
+	case auth == "xoauth2":
+		if _, err := a.pClient.Auth(xoauth2Auth{username, accessToken}); err != nil {
+			authFailed("sasl xoauth2:", err)
+		}
+	case auth == "oauthbearer":
+		if _, err := a.pClient.Auth(oauthBearerAuth{username, accessToken}); err != nil {
+			authFailed("sasl oauthbearer:", err)
+		}
+	}
+
 	if !noSASLExternal && a.pClient.State() == imap.Login {
 		if _, err := a.pClient.Auth(imap.ExternalAuth("")); err != nil {
-			log.Print("sasl external:", err)
+			authFailed("sasl external:", err)
 		}
 	}
 
-	if !noSASLPlainLogin && a.pClient.State() == imap.Login {
+	// OAuth2 accounts have no password.  Sending an empty one is of no use.
+	isPasswordAuthAdmitted := isCredentialAuthAdmitted && auth == ""
+
+	if isPasswordAuthAdmitted && !noSASLPlainLogin && a.pClient.State() == imap.Login {
 		if _, err := a.pClient.Auth(imap.PlainAuth(username, password, identity)); err != nil {
-			log.Print("sasl plain:", err)
+			authFailed("sasl plain:", err)
 		}
 	}
 
-	if !noSimpleLogin && a.pClient.State() == imap.Login {
+	if isPasswordAuthAdmitted && !noSimpleLogin && a.pClient.State() == imap.Login {
 		if _, err := a.pClient.Login(username, password); err != nil {
-			log.Print("login auth:", err)
+			authFailed("login auth:", err)
 		}
 	}
 
 	if a.pClient.State() != imap.Auth {
 		err = errors.New("authentication failed")
+		if transientError != nil {
+			err = fmt.Errorf("authentication failed: %w", transientError)
+		}
+		return
+	}
+
+	// imap server reports HIGHESTMODSEQ on selecting a mailbox once CONDSTORE is enabled.
+	// go-imap drops it unless told otherwise.  cf. [https://www.rfc-editor.org/rfc/rfc7162#section-3.1.2.1]
+	if a.pClient.Caps["CONDSTORE"] && a.pClient.Caps["ENABLE"] {
+		if _, err := a.pClient.Enable("CONDSTORE"); err != nil {
+			log.Printf("%s: enabling CONDSTORE failed.  rules consider each email: %v", host, err)
+		} else {
+			for _, name := range []string{"SELECT", "EXAMINE"} {
+				a.pClient.CommandConfig[name] = &imap.CommandConfig{States: imap.Auth | imap.Selected, Filter: selectFilter, Exclusive: true}
+			}
+		}
+	}
+
+	return
+}
+
+// selectFilter accepts SELECT and EXAMINE command responses including HIGHESTMODSEQ.
+func selectFilter(cmd *imap.Command, rsp *imap.Response) bool {
+	return imap.SelectFilter(cmd, rsp) || rsp.Label == "HIGHESTMODSEQ"
+}
+
+// highestModSeq returns HIGHESTMODSEQ reported by imap server on selecting a mailbox.
+// 0 if imap server does not support CONDSTORE or mailbox does not support MODSEQs.
+func highestModSeq(cmd *imap.Command) (modSeq uint64) {
+	for _, rsp := range cmd.Data {
+		if rsp.Label == "HIGHESTMODSEQ" && len(rsp.Fields) > 1 {
+			// go-imap parses numbers exceeding 32 bits as atoms.
+			modSeq, _ = strconv.ParseUint(fmt.Sprint(rsp.Fields[1]), 10, 64)
+		}
+	}
+	return
+}
+
+// setTrash sets the trash mailbox emails are moved to when deleting them.
+// If name is empty the mailbox having the \Trash attribute is looked for by imap's LIST command.
+// cf. [https://www.rfc-editor.org/rfc/rfc6154]
+// If no such mailbox exists trash remains unknown.
+func (a *serverProcessor_s) setTrash(name string) (err error) {
+	if name != "" {
+		a.trash = name
 		return
 	}
 
+	cmd, err := imap.Wait(a.pClient.List("", "*"))
+	if err != nil {
+		return
+	}
+
+	for _, rsp := range cmd.Data {
+		if info := rsp.MailboxInfo(); info != nil && info.Attrs["\\Trash"] {
+			a.trash = info.Name
+			log.Printf("%s: trash mailbox detected: %s", a.host, a.trash)
+			break
+		}
+	}
+
+	return
+}
+
+// reconnect drops the current session and connects imap server again.
+func (a *serverProcessor_s) reconnect() (err error) {
+	a.pClient.Logout(logoutTimeout)
+	err = a.redial()
 	return
 }
 
 func (a *serverProcessor_s) newMailboxProcessor() iMailboxProcessor {
-	return newMailboxProcessor(a.pClient)
+	return newMailboxProcessor(a)
+}
+
+// listMailboxes performs the LIST command and returns the names of all mailboxes on an imap server.
+func (a *serverProcessor_s) listMailboxes() (names []string, err error) {
+	cmd, err := imap.Wait(a.pClient.List("", "*"))
+	if err != nil {
+		return
+	}
+
+	for _, rsp := range cmd.Data {
+		if info := rsp.MailboxInfo(); info != nil {
+			names = append(names, info.Name)
+		}
+	}
+
+	return
 }
 
 // logout ends a session on an imap server.
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// testReply_s gives the untagged responses sent for commands starting with prefix.
+// A response starting with "TAG " completes the command instead of OK.
+type testReply_s struct {
+	prefix    string
+	responses []string
+}
+
+// defaultSelectReply answers selecting any mailbox not answered by other replies.
+var defaultSelectReply = testReply_s{"SELECT", []string{"* 5 EXISTS", "* OK [UIDVALIDITY 1] ok", "* OK [UIDNEXT 200] ok"}}
+
+// serveTestConn answers commands received by conn with replies.  Each command is completed
+// by OK unless a reply tells otherwise.  LOGOUT closes conn.  Commands received are sent to commands unless it is full.
+func serveTestConn(conn net.Conn, replies []testReply_s, commands chan string) {
+	r := bufio.NewReader(conn)
+	fmt.Fprint(conn, "* OK [CAPABILITY IMAP4rev1 AUTH=PLAIN AUTH=XOAUTH2] test server ready\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		tag, command, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		select {
+		case commands <- command:
+		default:
+		}
+		completion := tag + " OK done"
+		for _, reply := range replies {
+			if strings.HasPrefix(command, reply.prefix) {
+				for _, rsp := range reply.responses {
+					if status, isCompletion := strings.CutPrefix(rsp, "TAG "); isCompletion {
+						completion = tag + " " + status
+					} else {
+						fmt.Fprint(conn, rsp+"\r\n")
+					}
+				}
+				break
+			}
+		}
+		if command == "LOGOUT" {
+			fmt.Fprint(conn, "* BYE logging out\r\n"+completion+"\r\n")
+			conn.Close()
+			return
+		}
+		fmt.Fprint(conn, completion+"\r\n")
+	}
+}
+
+// newTestServer listens on a local port and answers each connection by serveTestConn.
+// It returns the address listened on and channels receiving the connections accepted and
+// the commands received.  Connections end when clients log out.
+func newTestServer(t *testing.T, replies ...testReply_s) (address string, connections chan net.Conn, commands chan string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+
+	replies = append(replies, defaultSelectReply)
+	connections = make(chan net.Conn, 100)
+	commands = make(chan string, 100)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			select {
+			case connections <- conn:
+			default:
+			}
+			go serveTestConn(conn, replies, commands)
+		}
+	}()
+
+	address = listener.Addr().String()
+	return
+}
+
+// newTestClient connects an imap client to a server answering commands by replies.
+// Each command is completed by OK.  The client is logged in and INBOX is selected.
+// Commands received are sent to the channel returned.
+func newTestClient(t *testing.T, replies ...testReply_s) (pClient *imap.Client, commands chan string) {
+	t.Helper()
+
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+
+	commands = make(chan string, 100)
+	go serveTestConn(serverConn, append(replies, defaultSelectReply), commands)
+
+	pClient, err := imap.NewClient(clientConn, "test", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = pClient.Login("user", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = pClient.Select("INBOX", false); err != nil {
+		t.Fatal(err)
+	}
+	for len(commands) > 0 {
+		<-commands
+	}
+
+	return
+}
+
+// receivedCommands returns the commands received by the server of newTestClient so far.
+func receivedCommands(commands chan string) (retval []string) {
+	for len(commands) > 0 {
+		retval = append(retval, <-commands)
+	}
+	return
+}
+
+func TestConnectOAuth2Failed(t *testing.T) {
+	address, _, commands := newTestServer(t, testReply_s{"AUTHENTICATE XOAUTH2", []string{"TAG NO invalid credentials"}})
+	pServer := &server_s{Host: address, TLS: "none"}
+	pDialer, err := newDialer(pServer, "none")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getCredentials := func() (password string, accessToken string, err error) {
+		accessToken = "token"
+		return
+	}
+
+	processor := newServerProcessor()
+	err = processor.connect(address, "none", false, false, true, "user", getCredentials, "", "xoauth2", "", true, pDialer, &tls.Config{})
+	if err == nil {
+		processor.logout()
+		t.Fatal("connect() succeeded, want authentication failed")
+	}
+
+	// neither SASL PLAIN nor LOGIN is tried with the empty password of an OAuth2 account.
+	for _, command := range receivedCommands(commands) {
+		if strings.HasPrefix(command, "AUTHENTICATE PLAIN") || strings.HasPrefix(command, "LOGIN") {
+			t.Errorf("%s sent after xoauth2 authentication failed", command)
+		}
+	}
+}
+
+func TestSelectMailbox(t *testing.T) {
+	tests := []struct {
+		name          string
+		mailbox       string
+		wantError     bool
+		wantTransient bool
+	}{
+		{name: "selected", mailbox: "INBOX"},
+		{name: "no such mailbox", mailbox: "Missing", wantError: true},
+		{name: "mailbox in use", mailbox: "Busy", wantError: true, wantTransient: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pClient, _ := newTestClient(t,
+				testReply_s{`SELECT "Missing"`, []string{"TAG NO no such mailbox"}},
+				testReply_s{`SELECT "Busy"`, []string{"TAG NO [INUSE] mailbox in use"}})
+
+			_, err := select_mailbox(pClient, test.mailbox, false)
+			if (err != nil) != test.wantError {
+				t.Fatalf("select_mailbox() error = %v, want error %v", err, test.wantError)
+			}
+			if err != nil && is_transient(err) != test.wantTransient {
+				t.Errorf("is_transient(%v) = %v, want %v", err, !test.wantTransient, test.wantTransient)
+			}
+		})
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name          string
+		isCopySent    bool
+		isClosed      bool
+		wantTransient bool
+	}{
+		{name: "rejected command", wantTransient: false},
+		{name: "connection closed", isClosed: true, wantTransient: true},
+		{name: "connection closed after copy", isCopySent: true, isClosed: true, wantTransient: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pClient, _ := newTestClient(t)
+			processor := newRuleProcessor(pClient, nil, "INBOX", "")
+			processor.isCopySent = test.isCopySent
+			if test.isClosed {
+				pClient.Logout(time.Second)
+			}
+
+			// imap server and go-imap refuse commands alike once the connection is closed.
+			err := processor.classify(imap.ErrNotAllowed)
+			if got := is_transient(err); got != test.wantTransient {
+				t.Errorf("is_transient(classify()) = %v, want %v", got, test.wantTransient)
+			}
+		})
+	}
+}
+
+func TestSearch(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses []string
+		want      string
+		wantCount int
+	}{
+		{name: "no email", responses: []string{"* SEARCH"}, want: ""},
+		{name: "emails", responses: []string{"* SEARCH 2 5"}, want: "2,5", wantCount: 2},
+		{name: "modseq appended", responses: []string{"* SEARCH 2 5 (MODSEQ 9)"}, want: "2,5", wantCount: 2},
+		{name: "several responses", responses: []string{"* SEARCH 2", "* SEARCH 5 (MODSEQ 9)"}, want: "2,5", wantCount: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pClient, _ := newTestClient(t, testReply_s{"UID SEARCH", test.responses})
+			processor := newRuleProcessor(pClient, nil, "INBOX", "")
+			processor.append("MODSEQ")
+			processor.append("9")
+
+			if err := processor.search(); err != nil {
+				t.Fatal(err)
+			}
+			if got := processor.pSearchResults.String(); got != test.want {
+				t.Errorf("search() found %q, want %q", got, test.want)
+			}
+			if processor.nrSearchResults != test.wantCount {
+				t.Errorf("search() counted %d emails, want %d", processor.nrSearchResults, test.wantCount)
+			}
+		})
+	}
+}
+
+func TestProcessMailboxRetriesSelect(t *testing.T) {
+	address, connections, _ := newTestServer(t, testReply_s{`SELECT "Busy"`, []string{"TAG NO [INUSE] mailbox in use"}})
+	pServer := &server_s{
+		Host:           address,
+		TLS:            "none",
+		AllowPlainAuth: true,
+		NoSASLExternal: true,
+		Username:       "user",
+		Password:       "password"}
+
+	processor := newServerProcessor()
+	if err := connect_server(processor, pServer, &tls.Config{}); err != nil {
+		t.Fatal(err)
+	}
+	defer processor.logout()
+
+	retry := retry_s{retries: 2, delay: time.Millisecond, maxDelay: time.Millisecond}
+	err := process_mailbox(processor.newMailboxProcessor(), &mailbox_s{Name: "Busy"}, maxMatches_s{}, retry)
+	if err == nil || !is_transient(err) {
+		t.Errorf("process_mailbox() error = %v, want INUSE", err)
+	}
+	// each retry connects again.
+	if got := len(connections); got != 1+retry.retries {
+		t.Errorf("%d connections, want %d", got, 1+retry.retries)
+	}
+}
@@ -2,11 +2,19 @@
 // Goifo is intended for use in cronjobs.
 // It is controlled by a configuration file described in a separate [./README.md].
 //
-// Start goifo without command line parameter just as follows:
+// Start goifo just as follows:
 //
 // Usage:
 //
-//	goifo
+//	goifo [-config file] [run|check|preview|explain|list-mailboxes|check-certs|daemon]
+//
+// Without command goifo performs run, i.e. a dry run followed by the real run.
+// check performs the dry run only.  preview opens mailboxes read-only and prints
+// the emails each rule would move or delete.  explain prints the search keys
+// each rule produces.  list-mailboxes prints the mailboxes of each imap server.
+// check-certs prints the certificates of ca.pem and of each imap server.
+// daemon performs real runs according to interval or cron given in config file
+// until SIGTERM is received.  SIGHUP reloads config file.
 //
 // Goifo will produce a lot of debugging informations on stderr, i.e. error messages and network protocol.
 package main
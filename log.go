@@ -0,0 +1,79 @@
+package main
+
+// All stuff about logging imap sessions.
+// Credentials are masked before imap commands and protocol lines are logged.
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// logLevels maps log levels admitted in config file to go-imap's log masks.
+var logLevels = map[string]imap.LogMask{
+	"none":     imap.LogNone,
+	"commands": imap.LogCmd,
+	"raw":      imap.LogRaw,
+}
+
+// defaultLogLevel is used if log_level is given neither globally nor for a server.
+const defaultLogLevel = "raw"
+
+// logMask returns go-imap's log mask corresponding to level.
+func logMask(level string) (mask imap.LogMask, err error) {
+	if level == "" {
+		level = defaultLogLevel
+	}
+
+	mask, isAdmitted := logLevels[level]
+	if !isAdmitted {
+		err = fmt.Errorf("unknown log_level %s.  admitted are none, commands and raw", level)
+	}
+
+	return
+}
+
+// credentialCommand matches imap commands carrying credentials as they are logged by go-imap,
+// i.e. "C: tag LOGIN ..." in raw log and ">>> tag LOGIN ..." in command log.
+var credentialCommand = regexp.MustCompile(`^((?:C:|>>>) (\S+) (?:LOGIN|AUTHENTICATE \S+))( .*)?$`)
+
+// logRedactor_s is a destination of go-imap's log which masks credentials
+// and forwards the log to pLogger.  Each imap session has its own one.
+type logRedactor_s struct {
+	pLogger *log.Logger
+	host    string // imap server logged about.  Prefixes each line.
+	authTag string // tag of LOGIN or AUTHENTICATE command in progress.  Its continuation lines are masked.
+}
+
+func (a *logRedactor_s) Write(p []byte) (n int, err error) {
+	n = len(p)
+	err = a.pLogger.Output(2, a.host+": "+a.redact(strings.TrimSuffix(string(p), "\n")))
+	return
+}
+
+// redact masks arguments of LOGIN and AUTHENTICATE commands and client lines
+// sent until they complete, i.e. SASL exchanges and the remainder of LOGIN
+// commands sent after literals.
+func (a *logRedactor_s) redact(line string) string {
+	if match := credentialCommand.FindStringSubmatch(line); match != nil {
+		a.authTag = match[2]
+		if match[3] != "" {
+			return match[1] + " <redacted>"
+		}
+		return line
+	}
+
+	if a.authTag != "" {
+		if strings.HasPrefix(line, "C: ") {
+			return "C: <redacted>"
+		}
+		if strings.HasPrefix(line, "S: "+a.authTag+" ") || strings.HasPrefix(line, "<<< "+a.authTag+" ") {
+			a.authTag = ""
+		}
+	}
+
+	return line
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string // lines logged by go-imap one after another.
+		want  []string
+	}{
+		{
+			name:  "login",
+			lines: []string{`C: A1 LOGIN "user" "secret"`, `S: A1 OK logged in`, `C: A2 SELECT "INBOX"`},
+			want:  []string{`C: A1 LOGIN <redacted>`, `S: A1 OK logged in`, `C: A2 SELECT "INBOX"`}},
+		{
+			name:  "login in command log",
+			lines: []string{`>>> A1 LOGIN "user" "secret"`, `<<< A1 OK logged in`, `>>> A2 SELECT "INBOX"`},
+			want:  []string{`>>> A1 LOGIN <redacted>`, `<<< A1 OK logged in`, `>>> A2 SELECT "INBOX"`}},
+		{
+			name: "login by literal",
+			lines: []string{
+				`C: A1 LOGIN {5}`,
+				`S: + ready`,
+				`C: literal 5 bytes`,
+				`C:  "secret"`,
+				`S: A1 OK logged in`,
+				`C: A2 SELECT "INBOX"`},
+			want: []string{
+				`C: A1 LOGIN <redacted>`,
+				`S: + ready`,
+				`C: <redacted>`,
+				`C: <redacted>`,
+				`S: A1 OK logged in`,
+				`C: A2 SELECT "INBOX"`}},
+		{
+			name: "login by literal in command log",
+			lines: []string{
+				`>>> A1 LOGIN {5} "secret"`,
+				`<<< A1 OK logged in`},
+			want: []string{
+				`>>> A1 LOGIN <redacted>`,
+				`<<< A1 OK logged in`}},
+		{
+			name:  "authenticate with initial response",
+			lines: []string{`C: A1 AUTHENTICATE PLAIN AHVzZXIAc2VjcmV0`, `S: A1 OK authenticated`, `C: A2 NOOP`},
+			want:  []string{`C: A1 AUTHENTICATE PLAIN <redacted>`, `S: A1 OK authenticated`, `C: A2 NOOP`}},
+		{
+			name: "authenticate by continuation",
+			lines: []string{
+				`C: A1 AUTHENTICATE PLAIN`,
+				`S: + `,
+				`C: AHVzZXIAc2VjcmV0`,
+				`S: A1 OK authenticated`,
+				`C: A2 NOOP`},
+			want: []string{
+				`C: A1 AUTHENTICATE PLAIN`,
+				`S: + `,
+				`C: <redacted>`,
+				`S: A1 OK authenticated`,
+				`C: A2 NOOP`}},
+		{
+			name: "failed authentication followed by login",
+			lines: []string{
+				`C: A1 AUTHENTICATE XOAUTH2`,
+				`S: + eyJzdGF0dXMiOiI0MDAifQ==`,
+				`C: `,
+				`S: A1 NO invalid credentials`,
+				`C: A2 LOGIN "user" "secret"`,
+				`S: A2 OK logged in`},
+			want: []string{
+				`C: A1 AUTHENTICATE XOAUTH2`,
+				`S: + eyJzdGF0dXMiOiI0MDAifQ==`,
+				`C: <redacted>`,
+				`S: A1 NO invalid credentials`,
+				`C: A2 LOGIN <redacted>`,
+				`S: A2 OK logged in`}},
+		{
+			name:  "other commands",
+			lines: []string{`C: A1 UID SEARCH FROM "login"`, `S: * SEARCH 1`, `S: A1 OK done`},
+			want:  []string{`C: A1 UID SEARCH FROM "login"`, `S: * SEARCH 1`, `S: A1 OK done`}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			redactor := logRedactor_s{}
+			for i, line := range test.lines {
+				if got := redactor.redact(line); got != test.want[i] {
+					t.Errorf("redact(%q) = %q, want %q", line, got, test.want[i])
+				}
+			}
+		})
+	}
+}
@@ -3,48 +3,228 @@ package main
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"os"
 )
 
+// exit codes of goifo.  Other errors cause exit code 1.
+const (
+	exitConfigError    = 2 // config file or command line is broken.  Nothing was done.
+	exitPartialFailure = 3 // some servers or mailboxes failed, others succeeded.
+	exitTotalFailure   = 4 // all servers and mailboxes failed.
+)
+
+// command_s describes a subcommand given on command line.
+type command_s struct {
+	name        string
+	description string
+	action      func(pConfigData *goifo_conf_s, pTLSConfig *tls.Config) (err error)
+}
+
+// commands enumerates all subcommands admitted on command line.
+// The first one is performed if no subcommand is given.
+var commands = []command_s{
+	{"run", "perform a dry run followed by the real run", runCommand},
+	{"check", "perform the dry run only, no imap server is contacted", checkCommand},
+	{"preview", "connect read-only and print the emails each rule would move or delete", previewCommand},
+	{"explain", "print the imap SEARCH keys each rule produces", explainCommand},
+	{"list-mailboxes", "print the mailboxes of each imap server", listMailboxesCommand},
+	{"check-certs", "print the certificates of ca.pem and of each imap server and warn about expiring ones", checkCertsCommand},
+	{"daemon", "perform the dry run followed by real runs according to interval or cron until SIGTERM", daemonCommand},
+}
+
+// usage prints a help message on stderr.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [options] [command]\n\nCommands:\n", projectName)
+	for _, command := range commands {
+		fmt.Fprintf(out, "  %-16s %s\n", command.name, command.description)
+	}
+	fmt.Fprintf(out, "\nOptions:\n")
+	flag.PrintDefaults()
+}
+
+// checkCommand performs a dry run of goifo to get sure material on imap server will not be crippled because
+// errors in config file.
+func checkCommand(pConfigData *goifo_conf_s, pTLSConfig *tls.Config) (err error) {
+	configProcessor := dryRunConfigProcessor_s{}
+
+	err = process_goifo_conf(&configProcessor, pConfigData, pTLSConfig, nil)
+
+	// interval and cron are used by daemon only but checked by each command.
+	if _, scheduleError := new_schedule(pConfigData); scheduleError != nil {
+		err = errors.Join(err, scheduleError)
+	}
+
+	if err != nil {
+		err = &configError{fmt.Errorf("[dry run] %w", err)}
+	}
+
+	return
+}
+
+// runCommand performs the dry run and stops goifo's action if errors occure.
+// Otherwise it performs the real run of goifo.
+func runCommand(pConfigData *goifo_conf_s, pTLSConfig *tls.Config) (err error) {
+	if err = checkCommand(pConfigData, pTLSConfig); err != nil {
+		return
+	}
+
+	configProcessor := configProcessor_s{}
+	err = process_report(&configProcessor, pConfigData, pTLSConfig)
+
+	return
+}
+
+// previewCommand performs the dry run and stops goifo's action if errors occure.
+// Otherwise it examines mailboxes read-only and prints what the real run would do.
+func previewCommand(pConfigData *goifo_conf_s, pTLSConfig *tls.Config) (err error) {
+	if err = checkCommand(pConfigData, pTLSConfig); err != nil {
+		return
+	}
+
+	configProcessor := previewConfigProcessor_s{}
+	err = process_report(&configProcessor, pConfigData, pTLSConfig)
+
+	return
+}
+
+// process_report processes all servers, prints a summary table of outcomes and
+// returns a runFailureError if some server or mailbox failed.
+func process_report(processor iConfigProcessor, pConfigData *goifo_conf_s, pTLSConfig *tls.Config) (err error) {
+	report := report_s{}
+	process_goifo_conf(processor, pConfigData, pTLSConfig, &report)
+
+	report.print(os.Stdout)
+	err = report.failure()
+
+	return
+}
+
+// explainCommand prints the search keys and actions of each rule without contacting any imap server.
+func explainCommand(pConfigData *goifo_conf_s, pTLSConfig *tls.Config) (err error) {
+	// servers are explained one after another so that output is not interleaved.
+	configData := *pConfigData
+	configData.Concurrency = 1
+
+	configProcessor := explainConfigProcessor_s{}
+	if err = process_goifo_conf(&configProcessor, &configData, pTLSConfig, nil); err != nil {
+		err = &configError{err}
+	}
+
+	return
+}
+
+// listMailboxesCommand connects each imap server and prints its mailboxes.
+func listMailboxesCommand(pConfigData *goifo_conf_s, pTLSConfig *tls.Config) (err error) {
+	for _, server := range pConfigData.Servers {
+		serverProcessor := newServerProcessor()
+		if connectError := connect_server(serverProcessor, &server, pTLSConfig); connectError != nil {
+			err = errors.Join(err, fmt.Errorf("%s: %w", server.Host, connectError))
+			continue
+		}
+
+		names, listError := serverProcessor.listMailboxes()
+		for _, name := range names {
+			fmt.Printf("%s: %s\n", server.Host, name)
+		}
+
+		err = errors.Join(err, listError, serverProcessor.logout())
+	}
+
+	return
+}
+
+// checkCertsCommand prints subject, expiry and fingerprint of each certificate in ca.pem and
+// of certificate chains presented by imap servers.  Certificates expiring soon are warned about.
+func checkCertsCommand(pConfigData *goifo_conf_s, pTLSConfig *tls.Config) (err error) {
+	for _, pCertificate := range caCertificates {
+		fmt.Printf("%s: %s\n", caFile, describe_cert(pCertificate))
+	}
+
+	for _, server := range pConfigData.Servers {
+		chain, verifyError, connectError := fetch_server_chain(&server, pTLSConfig)
+		if connectError != nil {
+			err = errors.Join(err, fmt.Errorf("%s: %w", server.Host, connectError))
+			continue
+		}
+
+		for i, pCertificate := range chain {
+			fmt.Printf("%s #%d: %s\n", server.Host, i, describe_cert(pCertificate))
+			warn_expiry(server.Host, pCertificate, pConfigData.CertWarningWindow)
+		}
+		if verifyError != nil {
+			log.Printf("WARNING: %s: certificate chain not accepted: %v", server.Host, verifyError)
+		}
+	}
+
+	return
+}
+
 func main() {
 	// initialize global variables.
 	if err := initConstants(); err != nil {
 		log.Fatal("problem during initializing constants", err)
 	}
 
-	pCertPool, err := x509.SystemCertPool()
-	if err != nil {
-		log.Fatal("problem getting system cert pool", err)
+	flag.StringVar(&configFile, "config", configFile, "name of config file")
+	flag.Usage = usage
+	flag.Parse()
+
+	var pCommand *command_s
+	switch flag.NArg() {
+	case 0:
+		pCommand = &commands[0]
+	case 1:
+		for i := range commands {
+			if commands[i].name == flag.Arg(0) {
+				pCommand = &commands[i]
+			}
+		}
 	}
-	if err := get_ca_cert_pool(pCertPool); err != nil {
-		log.Fatal("problem reading ca certificates", err)
+	if pCommand == nil {
+		usage()
+		os.Exit(exitConfigError)
 	}
-	tlsConfig := tls.Config{
-		RootCAs: pCertPool}
 
 	// load config file and interprete yaml.
 	var configData goifo_conf_s
 	if err := loadConfig(configFile, &configData); err != nil {
-		log.Fatal("config file could not be interpret as an yaml file:", err)
+		log.Print("config file could not be interpret as an yaml file:", err)
+		os.Exit(exitConfigError)
 	}
 
-	// performs a dry run of goifo to get sure material on imap server will not be crippled because
-	// errors in config file.  stops goifo's action if errors occure.
-	{
-		configProcessor := dryRunConfigProcessor_s{}
-
-		if err := process_goifo_conf(&configProcessor, &configData, &tlsConfig); err != nil {
-			log.Fatal("[dry run] ", err)
-		}
+	pCertPool, err := x509.SystemCertPool()
+	if err != nil {
+		log.Fatal("problem getting system cert pool", err)
 	}
+	if err := get_ca_cert_pool(pCertPool, configData.CertWarningWindow); err != nil {
+		log.Fatal("problem reading ca certificates", err)
+	}
+	tlsConfig := tls.Config{
+		RootCAs: pCertPool}
 
-	// performs the real run of goifo.
-	{
-		configProcessor := configProcessor_s{}
+	if err := pCommand.action(&configData, &tlsConfig); err != nil {
+		log.Print(err)
+		os.Exit(exit_code(err))
+	}
+}
 
-		if err := process_goifo_conf(&configProcessor, &configData, &tlsConfig); err != nil {
-			log.Fatal(err)
-		}
+// exit_code maps an error returned by a command to goifo's exit code.
+func exit_code(err error) int {
+	var pConfigError *configError
+	var pRunFailure *runFailureError
+	switch {
+	case errors.As(err, &pConfigError):
+		return exitConfigError
+	case errors.As(err, &pRunFailure) && pRunFailure.isTotal:
+		return exitTotalFailure
+	case errors.As(err, &pRunFailure):
+		return exitPartialFailure
 	}
 
+	return 1
 }
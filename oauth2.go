@@ -0,0 +1,231 @@
+package main
+
+// All stuff about OAuth2 authentication by SASL mechanisms XOAUTH2 and OAUTHBEARER.
+// Access tokens are obtained from a token endpoint by a refresh token and cached in
+// goifo's state dir so that they are reused as long as they are valid.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// httpClient is used for requesting token endpoints.
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// accessTokenMargin is the time span an access token has to be valid at least for reusing it.
+const accessTokenMargin = 60 * time.Second
+
+// tokenCache_s describes the content of a file caching an access token.
+type tokenCache_s struct {
+	RefreshTokenHash string    `json:"refresh_token_hash"`      // hash of refresh token given in config file.
+	RefreshToken     string    `json:"refresh_token,omitempty"` // refresh token issued by token endpoint replacing that of config file.
+	AccessToken      string    `json:"access_token"`
+	Expiry           time.Time `json:"expiry"`
+}
+
+// tokenResponse_s describes the response of a token endpoint.
+// cf. [https://www.rfc-editor.org/rfc/rfc6749#section-5]
+type tokenResponse_s struct {
+	AccessToken      string `json:"access_token"`
+	ExpiresIn        int64  `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// check_oauth2 checks whether everything needed for obtaining an access token is given.
+func check_oauth2(host string, username string, pOAuth2 *oauth2_s) (err error) {
+	if username == "" {
+		err = errors.Join(err, fmt.Errorf("%s: oauth2 authentication requires username", host))
+	}
+	if pOAuth2.TokenEndpoint == "" {
+		err = errors.Join(err, fmt.Errorf("%s: oauth2 authentication requires token_endpoint", host))
+	} else if _, parseError := url.ParseRequestURI(pOAuth2.TokenEndpoint); parseError != nil {
+		err = errors.Join(err, fmt.Errorf("%s: token_endpoint: %w", host, parseError))
+	}
+	if pOAuth2.ClientID == "" {
+		err = errors.Join(err, fmt.Errorf("%s: oauth2 authentication requires client_id", host))
+	}
+	if pOAuth2.RefreshToken == "" {
+		err = errors.Join(err, fmt.Errorf("%s: oauth2 authentication requires refresh_token", host))
+	}
+
+	return
+}
+
+// tokenCacheFile names the file caching access tokens of username on host.
+func tokenCacheFile(host string, username string) string {
+	sum := sha256.Sum256([]byte(host + "\x00" + username))
+	return filepath.Join(stateDir, "oauth2", hex.EncodeToString(sum[:8])+".json")
+}
+
+// hashRefreshToken makes it possible to detect changes of a refresh token without storing it.
+func hashRefreshToken(refreshToken string) string {
+	sum := sha256.Sum256([]byte(refreshToken))
+	return hex.EncodeToString(sum[:])
+}
+
+// readTokenCache reads a cached access token.  An empty cache is returned if there is none
+// or if it was derived from a refresh token other than that of config file.
+func readTokenCache(fileName string, refreshToken string) (cache tokenCache_s) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return
+	}
+
+	if json.Unmarshal(data, &cache) != nil || cache.RefreshTokenHash != hashRefreshToken(refreshToken) {
+		cache = tokenCache_s{}
+	}
+
+	return
+}
+
+// writeTokenCache caches an access token.  The file is readable by its owner only.
+func writeTokenCache(fileName string, cache *tokenCache_s) (err error) {
+	err = os.MkdirAll(filepath.Dir(fileName), 0700)
+	if err != nil {
+		return
+	}
+
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return
+	}
+
+	err = os.WriteFile(fileName, data, 0600)
+
+	return
+}
+
+// refresh_access_token requests a new access token from token endpoint.
+// cf. [https://www.rfc-editor.org/rfc/rfc6749#section-6]
+func refresh_access_token(pOAuth2 *oauth2_s, refreshToken string) (response tokenResponse_s, err error) {
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {pOAuth2.ClientID}}
+	if pOAuth2.ClientSecret != "" {
+		form.Set("client_secret", pOAuth2.ClientSecret)
+	}
+
+	rsp, err := httpClient.PostForm(pOAuth2.TokenEndpoint, form)
+	if err != nil {
+		return
+	}
+	defer rsp.Body.Close()
+
+	decodeError := json.NewDecoder(rsp.Body).Decode(&response)
+	switch {
+	case response.Error != "":
+		err = fmt.Errorf("token endpoint: %s %s", response.Error, response.ErrorDescription)
+	case rsp.StatusCode != http.StatusOK:
+		err = fmt.Errorf("token endpoint: %s", rsp.Status)
+	case decodeError != nil:
+		err = fmt.Errorf("token endpoint: %w", decodeError)
+	case response.AccessToken == "":
+		err = errors.New("token endpoint: no access token issued")
+	}
+
+	return
+}
+
+// getAccessToken returns a cached access token of username on host if it is still valid.
+// Otherwise a new one is requested from token endpoint and cached.
+func (a *serverProcessor_s) getAccessToken(host string, username string, pOAuth2 *oauth2_s) (accessToken string, err error) {
+	err = check_oauth2(host, username, pOAuth2)
+	if err != nil {
+		return
+	}
+
+	fileName := tokenCacheFile(host, username)
+	cache := readTokenCache(fileName, pOAuth2.RefreshToken)
+	if cache.AccessToken != "" && time.Now().Add(accessTokenMargin).Before(cache.Expiry) {
+		accessToken = cache.AccessToken
+		return
+	}
+
+	refreshToken := pOAuth2.RefreshToken
+	if cache.RefreshToken != "" {
+		refreshToken = cache.RefreshToken
+	}
+
+	response, err := refresh_access_token(pOAuth2, refreshToken)
+	if err != nil {
+		err = fmt.Errorf("%s: %w", host, err)
+		return
+	}
+
+	// token endpoints issue a new refresh token only if they rotate them.
+	if response.RefreshToken == "" {
+		response.RefreshToken = cache.RefreshToken
+	}
+
+	cache = tokenCache_s{
+		RefreshTokenHash: hashRefreshToken(pOAuth2.RefreshToken),
+		RefreshToken:     response.RefreshToken,
+		AccessToken:      response.AccessToken,
+		Expiry:           time.Now().Add(time.Duration(response.ExpiresIn) * time.Second)}
+	if response.ExpiresIn == 0 {
+		// token endpoint does not tell expiry.  Do not reuse access token.
+		cache.Expiry = time.Now()
+	}
+	if cacheError := writeTokenCache(fileName, &cache); cacheError != nil {
+		log.Print("caching access token:", cacheError)
+	}
+
+	accessToken = response.AccessToken
+
+	return
+}
+
+// xoauth2Auth implements imap.SASL for mechanism XOAUTH2.
+// cf. [https://developers.google.com/gmail/imap/xoauth2-protocol]
+type xoauth2Auth struct {
+	username    string
+	accessToken string
+}
+
+func (a xoauth2Auth) Start(s *imap.ServerInfo) (mech string, ir []byte, err error) {
+	mech = "XOAUTH2"
+	ir = []byte("user=" + a.username + "\x01auth=Bearer " + a.accessToken + "\x01\x01")
+	return
+}
+
+// Next answers an error message sent by imap server as challenge by an empty response.
+func (a xoauth2Auth) Next(challenge []byte) (response []byte, err error) {
+	response = []byte{}
+	log.Print("xoauth2: ", strings.TrimSpace(string(challenge)))
+	return
+}
+
+// oauthBearerAuth implements imap.SASL for mechanism OAUTHBEARER.
+// cf. [https://www.rfc-editor.org/rfc/rfc7628]
+type oauthBearerAuth struct {
+	username    string
+	accessToken string
+}
+
+func (a oauthBearerAuth) Start(s *imap.ServerInfo) (mech string, ir []byte, err error) {
+	mech = "OAUTHBEARER"
+	ir = []byte("n,a=" + strings.NewReplacer(",", "=2C", "=", "=3D").Replace(a.username) + ",\x01auth=Bearer " + a.accessToken + "\x01\x01")
+	return
+}
+
+// Next answers an error message sent by imap server as challenge by a dummy response.
+func (a oauthBearerAuth) Next(challenge []byte) (response []byte, err error) {
+	response = []byte("\x01")
+	log.Print("oauthbearer: ", strings.TrimSpace(string(challenge)))
+	return
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// tokenEndpoint_s is a token endpoint answering refresh requests by responses one after another.
+// Refresh tokens sent by requests are recorded.
+type tokenEndpoint_s struct {
+	responses     []map[string]any
+	refreshTokens []string
+}
+
+func (a *tokenEndpoint_s) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.refreshTokens = append(a.refreshTokens, r.PostFormValue("refresh_token"))
+	if len(a.refreshTokens) > len(a.responses) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]any{"error": "invalid_grant"})
+		return
+	}
+	json.NewEncoder(w).Encode(a.responses[len(a.refreshTokens)-1])
+}
+
+func TestGetAccessToken(t *testing.T) {
+	tests := []struct {
+		name              string
+		responses         []map[string]any
+		nrCalls           int
+		wantAccessToken   string
+		wantRefreshTokens []string
+		wantError         bool
+	}{
+		{
+			name: "cached while valid",
+			responses: []map[string]any{
+				{"access_token": "a1", "expires_in": 3600}},
+			nrCalls:           2,
+			wantAccessToken:   "a1",
+			wantRefreshTokens: []string{"r0"}},
+		{
+			name: "not cached without expiry",
+			responses: []map[string]any{
+				{"access_token": "a1"},
+				{"access_token": "a2"}},
+			nrCalls:           2,
+			wantAccessToken:   "a2",
+			wantRefreshTokens: []string{"r0", "r0"}},
+		{
+			name: "not cached if expiring soon",
+			responses: []map[string]any{
+				{"access_token": "a1", "expires_in": 30},
+				{"access_token": "a2", "expires_in": 30}},
+			nrCalls:           2,
+			wantAccessToken:   "a2",
+			wantRefreshTokens: []string{"r0", "r0"}},
+		{
+			name: "rotated refresh token is used",
+			responses: []map[string]any{
+				{"access_token": "a1", "refresh_token": "r1"},
+				{"access_token": "a2", "refresh_token": "r2"},
+				{"access_token": "a3"}},
+			nrCalls:           3,
+			wantAccessToken:   "a3",
+			wantRefreshTokens: []string{"r0", "r1", "r2"}},
+		{
+			name: "rotated refresh token is kept if not rotated again",
+			responses: []map[string]any{
+				{"access_token": "a1", "refresh_token": "r1"},
+				{"access_token": "a2"},
+				{"access_token": "a3"}},
+			nrCalls:           3,
+			wantAccessToken:   "a3",
+			wantRefreshTokens: []string{"r0", "r1", "r1"}},
+		{
+			name:              "error of token endpoint",
+			responses:         []map[string]any{},
+			nrCalls:           1,
+			wantRefreshTokens: []string{"r0"},
+			wantError:         true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stateDir = t.TempDir()
+			endpoint := &tokenEndpoint_s{responses: test.responses}
+			server := httptest.NewServer(endpoint)
+			defer server.Close()
+
+			oauth2 := oauth2_s{TokenEndpoint: server.URL, ClientID: "goifo", RefreshToken: "r0"}
+			processor := newServerProcessor()
+
+			var accessToken string
+			var err error
+			for i := 0; i < test.nrCalls; i++ {
+				accessToken, err = processor.getAccessToken("imap.example.org", "user", &oauth2)
+			}
+
+			if (err != nil) != test.wantError {
+				t.Fatalf("getAccessToken() error = %v, want error %v", err, test.wantError)
+			}
+			if accessToken != test.wantAccessToken {
+				t.Errorf("getAccessToken() = %q, want %q", accessToken, test.wantAccessToken)
+			}
+			if len(endpoint.refreshTokens) != len(test.wantRefreshTokens) {
+				t.Fatalf("refresh tokens sent = %q, want %q", endpoint.refreshTokens, test.wantRefreshTokens)
+			}
+			for i := range endpoint.refreshTokens {
+				if endpoint.refreshTokens[i] != test.wantRefreshTokens[i] {
+					t.Errorf("refresh tokens sent = %q, want %q", endpoint.refreshTokens, test.wantRefreshTokens)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestGetAccessTokenChangedRefreshToken(t *testing.T) {
+	stateDir = t.TempDir()
+	endpoint := &tokenEndpoint_s{responses: []map[string]any{
+		{"access_token": "a1", "expires_in": 3600, "refresh_token": "r1"},
+		{"access_token": "a2", "expires_in": 3600}}}
+	server := httptest.NewServer(endpoint)
+	defer server.Close()
+
+	processor := newServerProcessor()
+	oauth2 := oauth2_s{TokenEndpoint: server.URL, ClientID: "goifo", RefreshToken: "r0"}
+	if _, err := processor.getAccessToken("imap.example.org", "user", &oauth2); err != nil {
+		t.Fatal(err)
+	}
+
+	// a refresh token edited in config file invalidates cache.
+	oauth2.RefreshToken = "new"
+	accessToken, err := processor.getAccessToken("imap.example.org", "user", &oauth2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accessToken != "a2" {
+		t.Errorf("getAccessToken() = %q, want %q", accessToken, "a2")
+	}
+	if want := []string{"r0", "new"}; len(endpoint.refreshTokens) != 2 || endpoint.refreshTokens[1] != want[1] {
+		t.Errorf("refresh tokens sent = %q, want %q", endpoint.refreshTokens, want)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+// All stuff about resolving passwords which are not given in config file.
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// check_password checks whether the password of server described by pServer is resolvable.
+// At most one of password, password_command, password_env and password_file may be given.
+// password_command is not run so that it prompts for a passphrase once per run only.
+// It is checked whether the program it starts is found.
+func check_password(pServer *server_s) (err error) {
+	nrSources := 0
+	for _, source := range []string{pServer.Password, pServer.PasswordCmd, pServer.PasswordEnv, pServer.PasswordFile} {
+		if source != "" {
+			nrSources++
+		}
+	}
+	if nrSources > 1 {
+		err = fmt.Errorf("%s: only one of password, password_command, password_env and password_file admitted", pServer.Host)
+		return
+	}
+
+	switch {
+	case pServer.PasswordCmd != "":
+		if commandError := check_command(pServer.PasswordCmd); commandError != nil {
+			err = fmt.Errorf("%s: password_command: %w", pServer.Host, commandError)
+		}
+	case pServer.PasswordEnv != "":
+		if _, isSet := os.LookupEnv(pServer.PasswordEnv); !isSet {
+			err = fmt.Errorf("%s: password_env: environment variable %s not set", pServer.Host, pServer.PasswordEnv)
+		}
+	case pServer.PasswordFile != "":
+		if _, statError := os.Stat(pServer.PasswordFile); statError != nil {
+			err = fmt.Errorf("%s: password_file: %w", pServer.Host, statError)
+		}
+	}
+
+	return
+}
+
+// check_command checks whether command is a valid shell command and whether the program
+// it starts is a shell builtin or found by PATH.  Variable assignments preceding it are skipped.
+func check_command(command string) (err error) {
+	output, err := exec.Command("/bin/sh", "-n", "-c", command).CombinedOutput()
+	if err != nil {
+		err = errors.New(strings.TrimSpace(string(output)))
+		return
+	}
+
+	words := strings.Fields(command)
+	for len(words) > 0 && strings.Contains(words[0], "=") {
+		words = words[1:]
+	}
+	if len(words) == 0 {
+		err = errors.New("no program given")
+		return
+	}
+
+	program := strings.Trim(words[0], `"'`)
+	if exec.Command("/bin/sh", "-c", `command -v "$1"`, "sh", program).Run() != nil {
+		err = fmt.Errorf("%s not found", program)
+	}
+
+	return
+}
+
+// resolve_password returns the password of server described by pServer.
+// It is taken either from config file directly, from the standard output of
+// password_command, from environment variable password_env or from file password_file.
+// Trailing line breaks are removed.
+func resolve_password(pServer *server_s) (password string, err error) {
+	err = check_password(pServer)
+	if err != nil {
+		return
+	}
+
+	switch {
+	case pServer.PasswordCmd != "":
+		password, err = password_from_command(pServer.PasswordCmd)
+		if err != nil {
+			err = fmt.Errorf("%s: password_command: %w", pServer.Host, err)
+			return
+		}
+	case pServer.PasswordEnv != "":
+		password = os.Getenv(pServer.PasswordEnv)
+	case pServer.PasswordFile != "":
+		password, err = password_from_file(pServer.PasswordFile)
+		if err != nil {
+			err = fmt.Errorf("%s: password_file: %w", pServer.Host, err)
+			return
+		}
+	default:
+		password = pServer.Password
+		return
+	}
+
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		err = fmt.Errorf("%s: password resolved is empty", pServer.Host)
+	}
+
+	return
+}
+
+// passwordCommandMutex serializes password commands since they share standard input and
+// the terminal, e.g. for prompting for a passphrase, while servers are processed concurrently.
+var passwordCommandMutex sync.Mutex
+
+// password_from_command runs command by shell and returns its standard output.
+// Standard error is passed through so that prompts of e.g. gpg-agent remain visible.
+// Standard output is never part of error messages.
+func password_from_command(command string) (password string, err error) {
+	passwordCommandMutex.Lock()
+	defer passwordCommandMutex.Unlock()
+
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		var pExitError *exec.ExitError
+		if errors.As(err, &pExitError) {
+			err = fmt.Errorf("%s: %s", command, pExitError.ProcessState)
+		}
+		return
+	}
+
+	password = string(output)
+
+	return
+}
+
+// password_from_file reads a password from file fileName.
+// A warning is logged if file is readable by others than its owner.
+func password_from_file(fileName string) (password string, err error) {
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		log.Printf("password file %s is accessible by others, mode %s", fileName, info.Mode().Perm())
+	}
+
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return
+	}
+
+	password = string(data)
+
+	return
+}
+
+// getPassword resolves password before connecting imap server.
+func (a *serverProcessor_s) getPassword(pServer *server_s) (password string, err error) {
+	password, err = resolve_password(pServer)
+	return
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckPassword(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOIFO_TEST_PASSWORD", "secret")
+
+	tests := []struct {
+		name      string
+		server    server_s
+		wantError bool
+	}{
+		{name: "password", server: server_s{Password: "secret"}},
+		{name: "no password", server: server_s{}},
+		{name: "several sources", server: server_s{Password: "secret", PasswordEnv: "GOIFO_TEST_PASSWORD"}, wantError: true},
+		{name: "command", server: server_s{PasswordCmd: "printf %s secret"}},
+		{name: "command by path", server: server_s{PasswordCmd: "/bin/sh -c 'echo secret'"}},
+		{name: "builtin", server: server_s{PasswordCmd: "echo secret"}},
+		{name: "command preceded by assignment", server: server_s{PasswordCmd: "LANG=C printf %s secret"}},
+		{name: "command not found", server: server_s{PasswordCmd: "/no/such/cmd"}, wantError: true},
+		{name: "command not found by PATH", server: server_s{PasswordCmd: "no-such-goifo-cmd show imap"}, wantError: true},
+		{name: "broken command", server: server_s{PasswordCmd: "echo 'secret"}, wantError: true},
+		{name: "environment variable", server: server_s{PasswordEnv: "GOIFO_TEST_PASSWORD"}},
+		{name: "environment variable not set", server: server_s{PasswordEnv: "GOIFO_TEST_NO_PASSWORD"}, wantError: true},
+		{name: "file", server: server_s{PasswordFile: passwordFile}},
+		{name: "file missing", server: server_s{PasswordFile: passwordFile + ".missing"}, wantError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.server.Host = "imap.example.org"
+			if err := check_password(&test.server); (err != nil) != test.wantError {
+				t.Errorf("check_password() error = %v, want error %v", err, test.wantError)
+			}
+		})
+	}
+}
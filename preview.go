@@ -0,0 +1,194 @@
+package main
+
+// Implements interfaces defined [here](config.go) for previewing what a real run would do.
+// Mailboxes are opened read-only by imap's EXAMINE command and searched for real but
+// neither COPY nor STORE nor expunging is performed.
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// wordDecoder decodes MIME encoded words in subjects and sender names.
+var wordDecoder mime.WordDecoder
+
+// decodeHeader decodes MIME encoded words in s.  s is returned unchanged if decoding fails.
+func decodeHeader(s string) string {
+	if decoded, err := wordDecoder.DecodeHeader(s); err == nil {
+		return decoded
+	}
+	return s
+}
+
+// formatAddresses formats an address list given in an imap ENVELOPE structure.
+func formatAddresses(f imap.Field) string {
+	var addresses []string
+	for _, a := range imap.AsList(f) {
+		parts := imap.AsList(a)
+		if len(parts) != 4 {
+			continue
+		}
+		address := imap.AsString(parts[2]) + "@" + imap.AsString(parts[3])
+		if name := imap.AsString(parts[0]); name != "" {
+			address = fmt.Sprintf("%s <%s>", decodeHeader(name), address)
+		}
+		addresses = append(addresses, address)
+	}
+	return strings.Join(addresses, ", ")
+}
+
+// previewRuleProcessor_s implements iRuleProcessor.
+// It performs the SEARCH command of ruleProcessor_s and prints the emails found.
+type previewRuleProcessor_s struct {
+	*ruleProcessor_s
+	prefix string // server, mailbox and rule number used for labelling output.
+}
+
+// search performs UID SEARCH command and prints date, sender and subject of each email found.
+func (a *previewRuleProcessor_s) search() (err error) {
+	err = a.ruleProcessor_s.search()
+	if err != nil {
+		return
+	}
+
+	fmt.Printf("%s: %d emails match\n", a.prefix, a.nrSearchResults)
+	if a.pSearchResults.Empty() {
+		return
+	}
+
+	cmd, err := imap.Wait(a.pClient.UIDFetch(a.pSearchResults, "ENVELOPE"))
+	if err != nil {
+		return
+	}
+
+	for _, rsp := range cmd.Data {
+		info := rsp.MessageInfo()
+		envelope := imap.AsList(info.Attrs["ENVELOPE"])
+		if len(envelope) < 3 {
+			continue
+		}
+		fmt.Printf("%s:   %d  %s  %s  %s\n",
+			a.prefix,
+			info.UID,
+			imap.AsString(envelope[0]),
+			formatAddresses(envelope[2]),
+			decodeHeader(imap.AsString(envelope[1])))
+	}
+
+	return
+}
+
+func (a *previewRuleProcessor_s) copy(dest string) (err error) {
+	fmt.Printf("%s: would copy %d emails to %s and keep them\n", a.prefix, a.nrSearchResults, dest)
+	return
+}
+
+func (a *previewRuleProcessor_s) move(dest string) (err error) {
+	fmt.Printf("%s: would copy %d emails to %s\n", a.prefix, a.nrSearchResults, dest)
+	return
+}
+
+func (a *previewRuleProcessor_s) markSrcForDel() (err error) {
+	fmt.Printf("%s: would delete %d emails\n", a.prefix, a.nrSearchResults)
+	return
+}
+
+// moveToTrash checks whether emails can be copied to trash mailbox and prints the result.
+func (a *previewRuleProcessor_s) moveToTrash() (err error) {
+	if a.trash == "" || a.mailbox == a.trash {
+		err = a.ruleProcessor_s.moveToTrash()
+		return
+	}
+
+	fmt.Printf("%s: would copy %d emails to trash mailbox %s\n", a.prefix, a.nrSearchResults, a.trash)
+	return
+}
+
+func (a *previewRuleProcessor_s) flag(flags []string) (err error) {
+	fmt.Printf("%s: would flag %d emails with %s\n", a.prefix, a.nrSearchResults, strings.Join(flags, " "))
+	return
+}
+
+func (a *previewRuleProcessor_s) unflag(flags []string) (err error) {
+	fmt.Printf("%s: would unflag %d emails from %s\n", a.prefix, a.nrSearchResults, strings.Join(flags, " "))
+	return
+}
+
+// previewMailboxProcessor_s implements iMailboxProcessor.
+type previewMailboxProcessor_s struct {
+	pServer  *serverProcessor_s // for reconnecting.
+	pClient  *imap.Client
+	name     string
+	trash    string
+	nrRule   int           // number of rules processed so far.
+	pTracker *uidTracker_s // tells which emails are new or changed since former runs.
+}
+
+// selectMailbox performs the EXAMINE command which opens a mailbox read-only.
+func (a *previewMailboxProcessor_s) selectMailbox(name string) (err error) {
+	a.name = name
+	cmd, err := select_mailbox(a.pClient, name, true)
+	if err == nil && a.pTracker == nil {
+		a.pTracker = newUIDTracker(a.pServer.host, a.pServer.username, name, a.pClient.Mailbox, highestModSeq(cmd))
+	}
+	return
+}
+
+// reopen reconnects imap server and examines mailbox again.
+// The rule failed is processed again and keeps its number.
+func (a *previewMailboxProcessor_s) reopen() (err error) {
+	// selecting mailbox is retried before the first rule.
+	if a.nrRule > 0 {
+		a.nrRule--
+	}
+
+	err = a.pServer.reconnect()
+	if err != nil {
+		return
+	}
+
+	a.pClient = a.pServer.pClient
+	err = a.selectMailbox(a.name)
+
+	return
+}
+
+func (a *previewMailboxProcessor_s) newRuleProcessor() iRuleProcessor {
+	a.nrRule++
+	processor := &previewRuleProcessor_s{
+		ruleProcessor_s: newRuleProcessor(a.pClient, nil, a.name, a.trash),
+		prefix:          fmt.Sprintf("%s/%s rule #%d", a.pServer.host, a.name, a.nrRule)}
+	processor.pTracker = a.pTracker
+	return processor
+}
+
+// close closes a mailbox without expunging any email.
+func (a *previewMailboxProcessor_s) close() (err error) {
+	_, err = a.pClient.Close(false)
+	return
+}
+
+// commit remembers nothing since emails are not processed for real.
+func (a *previewMailboxProcessor_s) commit() (err error) {
+	return
+}
+
+// previewServerProcessor_s implements iServerProcessor.
+type previewServerProcessor_s struct {
+	*serverProcessor_s
+}
+
+func (a *previewServerProcessor_s) newMailboxProcessor() iMailboxProcessor {
+	return &previewMailboxProcessor_s{pServer: a.serverProcessor_s, pClient: a.pClient, trash: a.trash}
+}
+
+// previewConfigProcessor_s implements iConfigProcessor.
+type previewConfigProcessor_s struct {
+}
+
+func (a *previewConfigProcessor_s) newServerProcessor() iServerProcessor {
+	return &previewServerProcessor_s{serverProcessor_s: newServerProcessor()}
+}
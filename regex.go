@@ -0,0 +1,206 @@
+package main
+
+// All stuff about REGEX_HEADER and REGEX_BODY preconditions.
+// imap's SEARCH command knows case-insensitive substring matching only.  So
+// regular expressions are matched locally against headers and bodies fetched
+// from imap server.  Emails matching are handed back to imap server as UID sets
+// so that these preconditions can be combined with any other one.
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// regexKey_s is a search key matched locally instead of by imap server.
+type regexKey_s struct {
+	header    string // name of header.  Empty if body is matched.
+	pRegexp   *regexp.Regexp
+	isNegated bool // true if key is placed below an odd number of NOT keys.
+}
+
+// appendRegex adds a search key matched locally.  A placeholder is added to
+// search keys which will be replaced by resolveRegexKeys.
+func (a *ruleProcessor_s) appendRegex(header string, pRegexp *regexp.Regexp, isNegated bool) {
+	a.accu = append(a.accu, &regexKey_s{header, pRegexp, isNegated})
+	a.nrRegexKeys++
+}
+
+// resolveRegexKeys replaces placeholders of search keys matched locally by UID sets.
+// First emails which may match are searched for replacing each placeholder by a key
+// which holds whenever the placeholder holds, i.e. ALL or, below NOT, NOT ALL.
+// Then headers or bodies of these candidates are fetched and matched.  If no candidate
+// is found spec is nil.
+func (a *ruleProcessor_s) resolveRegexKeys() (spec []imap.Field, err error) {
+	candidateSpec := []imap.Field{}
+	for _, f := range a.accu {
+		if pKey, ok := f.(*regexKey_s); ok {
+			if pKey.isNegated {
+				candidateSpec = append(candidateSpec, "NOT", "ALL")
+			} else {
+				candidateSpec = append(candidateSpec, "ALL")
+			}
+			continue
+		}
+		candidateSpec = append(candidateSpec, f)
+	}
+
+	cmd, err := imap.Wait(a.pClient.UIDSearch(candidateSpec...))
+	if err != nil {
+		return
+	}
+
+	pCandidates, _ := imap.NewSeqSet("")
+	for _, rsp := range cmd.Data {
+		pCandidates.AddNum(search_results(rsp)...)
+	}
+	if pCandidates.Empty() {
+		return
+	}
+
+	spec = []imap.Field{"UID", pCandidates}
+	for _, f := range a.accu {
+		pKey, ok := f.(*regexKey_s)
+		if !ok {
+			spec = append(spec, f)
+			continue
+		}
+
+		var pMatches *imap.SeqSet
+		pMatches, err = a.matchRegexKey(pKey, pCandidates)
+		if err != nil {
+			return
+		}
+
+		if pMatches.Empty() {
+			spec = append(spec, "NOT", "ALL")
+		} else {
+			spec = append(spec, "UID", pMatches)
+		}
+	}
+
+	return
+}
+
+// matchRegexKey fetches header or body of candidates and returns UIDs of those matching.
+func (a *ruleProcessor_s) matchRegexKey(pKey *regexKey_s, pCandidates *imap.SeqSet) (pMatches *imap.SeqSet, err error) {
+	pMatches, _ = imap.NewSeqSet("")
+
+	section := "BODY.PEEK[]"
+	if pKey.header != "" {
+		section = "BODY.PEEK[HEADER.FIELDS (" + pKey.header + ")]"
+	}
+
+	cmd, err := imap.Wait(a.pClient.UIDFetch(pCandidates, section))
+	if err != nil {
+		return
+	}
+
+	for _, rsp := range cmd.Data {
+		info := rsp.MessageInfo()
+
+		var data []byte
+		for k, v := range info.Attrs {
+			if strings.HasPrefix(k, "BODY[") {
+				data = imap.AsBytes(v)
+			}
+		}
+
+		isMatching := false
+		if pKey.header != "" {
+			isMatching = match_header(data, pKey.header, pKey.pRegexp)
+		} else {
+			isMatching = pKey.pRegexp.Match(message_text(data))
+		}
+		if isMatching {
+			pMatches.AddNum(info.UID)
+		}
+	}
+
+	return
+}
+
+// match_header checks whether one of the headers named header given in data matches pRegexp.
+// MIME encoded words are decoded before matching.
+func match_header(data []byte, header string, pRegexp *regexp.Regexp) bool {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+
+	for _, value := range msg.Header[textproto.CanonicalMIMEHeaderKey(header)] {
+		if pRegexp.MatchString(decodeHeader(value)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// message_text extracts the text parts of an email given in data.
+// Transfer encodings are decoded, attachments are skipped.  If the email cannot be
+// parsed data is returned unchanged.
+func message_text(data []byte) []byte {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return data
+	}
+
+	var text bytes.Buffer
+	append_part_text(&text, textproto.MIMEHeader(msg.Header), msg.Body)
+
+	return text.Bytes()
+}
+
+// append_part_text appends the text of a MIME part given by header and body to text.
+// Multipart parts are processed recursively.
+func append_part_text(text *bytes.Buffer, header textproto.MIMEHeader, body io.Reader) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err != nil {
+				return
+			}
+			append_part_text(text, part.Header, part)
+		}
+	}
+
+	if !strings.HasPrefix(mediaType, "text/") {
+		return
+	}
+
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+
+	// regular expressions are matched against UTF-8.  Like MIME encoded words in headers
+	// ISO-8859-1 is converted, other charsets are matched as they are.
+	switch strings.ToLower(params["charset"]) {
+	case "iso-8859-1", "latin1":
+		data, _ := io.ReadAll(body)
+		for _, b := range data {
+			text.WriteRune(rune(b))
+		}
+	default:
+		io.Copy(text, body)
+	}
+	text.WriteString("\n")
+}
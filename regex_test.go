@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+func TestMatchHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		header  string
+		pattern string
+		want    bool
+	}{
+		{"match", "Subject: [JIRA] test\r\n\r\n", "Subject", `^\[JIRA\]`, true},
+		{"no match", "Subject: Re: [JIRA] test\r\n\r\n", "Subject", `^\[JIRA\]`, false},
+		{"header name case-insensitive", "subject: [JIRA] test\r\n\r\n", "SUBJECT", `^\[JIRA\]`, true},
+		{"folded header", "Subject: [JIRA]\r\n test\r\n\r\n", "Subject", `^\[JIRA\] test$`, true},
+		{"encoded word", "Subject: =?UTF-8?B?w5xiZXJ3ZWlzdW5n?=\r\n\r\n", "Subject", `^Überweisung$`, true},
+		{"one of several headers", "Received: from a\r\nReceived: from b.ru\r\n\r\n", "Received", `\.ru$`, true},
+		{"missing header", "From: a@ex.org\r\n\r\n", "Subject", `.*`, false},
+		{"broken email", "no header at all", "Subject", `.*`, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := match_header([]byte(test.data), test.header, regexp.MustCompile(test.pattern)); got != test.want {
+				t.Errorf("match_header() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMessageText(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{
+			"plain",
+			"Subject: s\r\n\r\nhello",
+			"hello\n"},
+		{
+			"quoted-printable",
+			"Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nGr=C3=BC=C3=9Fe",
+			"Grüße\n"},
+		{
+			"base64",
+			"Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: base64\r\n\r\naGVsbG8=",
+			"hello\n"},
+		{
+			"latin1 charset",
+			"Content-Type: text/plain; charset=ISO-8859-1\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nGr=FC=DFe",
+			"Grüße\n"},
+		{
+			"multipart skips attachments",
+			"Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+				"--b\r\nContent-Type: text/plain\r\n\r\nhello\r\n" +
+				"--b\r\nContent-Type: application/pdf\r\n\r\n%PDF\r\n" +
+				"--b--\r\n",
+			"hello\n"},
+		{
+			"broken email",
+			"no header at all",
+			"no header at all"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := string(message_text([]byte(test.data))); got != test.want {
+				t.Errorf("message_text() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// fetchResponse builds a FETCH response carrying data as literal of section.
+func fetchResponse(seq uint32, uid uint32, section string, data string) string {
+	return fmt.Sprintf("* %d FETCH (UID %d %s {%d}\r\n%s)", seq, uid, section, len(data), data)
+}
+
+// fieldsString formats search keys the way they are sent to imap server.
+func fieldsString(spec []imap.Field) string {
+	var s []string
+	for _, f := range spec {
+		s = append(s, fmt.Sprint(f))
+	}
+	return strings.Join(s, " ")
+}
+
+func TestResolveRegexKeys(t *testing.T) {
+	subjects := []testReply_s{
+		{"UID FETCH", []string{
+			fetchResponse(1, 101, "BODY[HEADER.FIELDS (SUBJECT)]", "Subject: [JIRA] one\r\n\r\n"),
+			fetchResponse(2, 102, "BODY[HEADER.FIELDS (SUBJECT)]", "Subject: hello\r\n\r\n")}}}
+
+	tests := []struct {
+		name         string
+		accu         []imap.Field
+		pattern      string
+		isNegated    bool
+		candidates   string
+		wantCommands []string
+		wantSpec     string
+	}{
+		{
+			name:       "match",
+			accu:       []imap.Field{"UNSEEN"},
+			pattern:    `^\[JIRA\]`,
+			candidates: "* SEARCH 101 102",
+			wantCommands: []string{
+				"UID SEARCH CHARSET UTF-8 UNSEEN ALL",
+				"UID FETCH 101:102 (BODY.PEEK[HEADER.FIELDS (Subject)])"},
+			wantSpec: "UID 101:102 UNSEEN UID 101"},
+		{
+			name:       "negated",
+			accu:       []imap.Field{"NOT"},
+			pattern:    `^\[JIRA\]`,
+			isNegated:  true,
+			candidates: "* SEARCH 101 102",
+			wantCommands: []string{
+				"UID SEARCH CHARSET UTF-8 NOT NOT ALL",
+				"UID FETCH 101:102 (BODY.PEEK[HEADER.FIELDS (Subject)])"},
+			wantSpec: "UID 101:102 NOT UID 101"},
+		{
+			name:       "no email matches",
+			accu:       []imap.Field{},
+			pattern:    `^never`,
+			candidates: "* SEARCH 101 102",
+			wantCommands: []string{
+				"UID SEARCH CHARSET UTF-8 ALL",
+				"UID FETCH 101:102 (BODY.PEEK[HEADER.FIELDS (Subject)])"},
+			wantSpec: "UID 101:102 NOT ALL"},
+		{
+			name:       "modseq appended",
+			accu:       []imap.Field{"MODSEQ", "9"},
+			pattern:    `^\[JIRA\]`,
+			candidates: "* SEARCH 101 102 (MODSEQ 12)",
+			wantCommands: []string{
+				"UID SEARCH CHARSET UTF-8 MODSEQ 9 ALL",
+				"UID FETCH 101:102 (BODY.PEEK[HEADER.FIELDS (Subject)])"},
+			wantSpec: "UID 101:102 MODSEQ 9 UID 101"},
+		{
+			name:         "no candidate",
+			accu:         []imap.Field{"UNSEEN"},
+			pattern:      `^\[JIRA\]`,
+			candidates:   "* SEARCH",
+			wantCommands: []string{"UID SEARCH CHARSET UTF-8 UNSEEN ALL"},
+			wantSpec:     ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			replies := append([]testReply_s{{"UID SEARCH", []string{test.candidates}}}, subjects...)
+			pClient, commands := newTestClient(t, replies...)
+
+			processor := newRuleProcessor(pClient, nil, "INBOX", "")
+			processor.accu = append(processor.accu, test.accu...)
+			processor.appendRegex("Subject", regexp.MustCompile(test.pattern), test.isNegated)
+
+			spec, err := processor.resolveRegexKeys()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.wantSpec == "" && spec != nil {
+				t.Errorf("resolveRegexKeys() = %q, want nil", fieldsString(spec))
+			}
+			if got := fieldsString(spec); got != test.wantSpec {
+				t.Errorf("resolveRegexKeys() = %q, want %q", got, test.wantSpec)
+			}
+			if got := receivedCommands(commands); strings.Join(got, "\n") != strings.Join(test.wantCommands, "\n") {
+				t.Errorf("commands sent = %q, want %q", got, test.wantCommands)
+			}
+		})
+	}
+}
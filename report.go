@@ -0,0 +1,114 @@
+package main
+
+// All stuff about tracking outcomes of servers and mailboxes and summarizing them.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// outcome_s is the result of processing a mailbox.  If mailbox is empty it refers to the server
+// as a whole, e.g. connecting it failed.
+type outcome_s struct {
+	host    string
+	mailbox string
+	err     error
+}
+
+// report_s collects outcomes of a run.
+type report_s struct {
+	outcomes []outcome_s
+}
+
+// add records an outcome.  A nil report records nothing.
+func (a *report_s) add(host string, mailbox string, err error) {
+	if a == nil {
+		return
+	}
+
+	a.outcomes = append(a.outcomes, outcome_s{host, mailbox, err})
+}
+
+// merge appends the outcomes of pOther.  A nil report records nothing.
+func (a *report_s) merge(pOther *report_s) {
+	if a == nil {
+		return
+	}
+
+	a.outcomes = append(a.outcomes, pOther.outcomes...)
+}
+
+// print writes a summary table of all outcomes to out.
+func (a *report_s) print(out io.Writer) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVER\tMAILBOX\tRESULT")
+	for _, outcome := range a.outcomes {
+		mailbox := outcome.mailbox
+		if mailbox == "" {
+			mailbox = "-"
+		}
+		result := "ok"
+		if outcome.err != nil {
+			result = "FAILED"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", outcome.host, mailbox, result)
+	}
+	w.Flush()
+}
+
+// failure returns nil if every outcome is successful.  Otherwise a runFailureError
+// is returned telling whether some or all outcomes failed.
+func (a *report_s) failure() error {
+	pFailure := &runFailureError{}
+	for _, outcome := range a.outcomes {
+		if outcome.err != nil {
+			pFailure.nrFailed++
+			pFailure.err = errors.Join(pFailure.err, fmt.Errorf("%s: %w", outcome.label(), outcome.err))
+		}
+	}
+	if pFailure.nrFailed == 0 {
+		return nil
+	}
+
+	pFailure.isTotal = pFailure.nrFailed == len(a.outcomes)
+
+	return pFailure
+}
+
+// label names server and mailbox an outcome refers to.
+func (a outcome_s) label() string {
+	if a.mailbox == "" {
+		return a.host
+	}
+	return a.host + "/" + a.mailbox
+}
+
+// runFailureError reports failed servers or mailboxes.
+type runFailureError struct {
+	nrFailed int
+	isTotal  bool // true if nothing succeeded.
+	err      error
+}
+
+func (e *runFailureError) Error() string {
+	return e.err.Error()
+}
+
+func (e *runFailureError) Unwrap() error {
+	return e.err
+}
+
+// configError reports errors found by the dry run or when loading config file.
+type configError struct {
+	err error
+}
+
+func (e *configError) Error() string {
+	return e.err.Error()
+}
+
+func (e *configError) Unwrap() error {
+	return e.err
+}
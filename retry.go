@@ -0,0 +1,145 @@
+package main
+
+// All stuff about retrying operations which failed transiently, e.g. because
+// the connection dropped or imap server answered with UNAVAILABLE or INUSE.
+// cf. [https://www.rfc-editor.org/rfc/rfc5530]
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+const (
+	defaultRetryDelay    = time.Second // delay before first retry if retry_delay is not given.
+	defaultRetryMaxDelay = time.Minute // upper limit of delays if retry_max_delay is not given.
+)
+
+// retry_s describes how often and how patiently failed operations are retried.
+type retry_s struct {
+	host     string // server retries are logged about.
+	retries  int    // number of retries after the first attempt.
+	delay    time.Duration
+	maxDelay time.Duration
+}
+
+// retry_policy returns the retry settings of server described by pServer.
+func retry_policy(pServer *server_s) (policy retry_s, err error) {
+	policy = retry_s{
+		host:     pServer.Host,
+		retries:  pServer.Retries,
+		delay:    pServer.RetryDelay,
+		maxDelay: pServer.RetryMaxDelay}
+
+	if policy.delay == 0 {
+		policy.delay = defaultRetryDelay
+	}
+	if policy.maxDelay == 0 {
+		policy.maxDelay = defaultRetryMaxDelay
+	}
+
+	switch {
+	case policy.retries < 0:
+		err = fmt.Errorf("%s: retries must not be negative", pServer.Host)
+	case policy.delay < 0 || policy.maxDelay < 0:
+		err = fmt.Errorf("%s: retry_delay and retry_max_delay must not be negative", pServer.Host)
+	case policy.delay > policy.maxDelay:
+		err = fmt.Errorf("%s: retry_delay exceeds retry_max_delay", pServer.Host)
+	}
+
+	return
+}
+
+// do performs op.  If op fails transiently it is retried after a delay growing exponentially.
+// Before retrying, recover is called, e.g. for reconnecting imap server.  recover may be nil.
+func (a retry_s) do(label string, op func() error, recover func() error) (err error) {
+	for attempt := 0; ; attempt++ {
+		err = nil
+		if attempt > 0 && recover != nil {
+			err = recover()
+		}
+		if err == nil {
+			err = op()
+		}
+
+		if err == nil || attempt >= a.retries || !is_transient(err) {
+			return
+		}
+
+		delay := a.backoff(attempt)
+		log.Printf("%s: %s: %v.  retry %d of %d in %s", a.host, label, err, attempt+1, a.retries, delay)
+		time.Sleep(delay)
+	}
+}
+
+// backoff returns the delay before retry number attempt+1.  It doubles with each attempt
+// up to maxDelay.  A random jitter of up to half of it keeps several goifo instances
+// from hammering imap server simultaneously.
+func (a retry_s) backoff(attempt int) time.Duration {
+	delay := a.delay
+	for i := 0; i < attempt && delay < a.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > a.maxDelay {
+		delay = a.maxDelay
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// permanentError marks an error which must not be retried, e.g. since retrying a rule
+// would copy emails twice.
+type permanentError struct {
+	error
+}
+
+func (e permanentError) Unwrap() error {
+	return e.error
+}
+
+// connectionLostError marks an error of an imap command which failed since the connection
+// to imap server was closed before.
+type connectionLostError struct {
+	error
+}
+
+func (e connectionLostError) Unwrap() error {
+	return e.error
+}
+
+// is_transient tells whether err may disappear by retrying, i.e. network errors, dropped
+// connections and imap responses having response code UNAVAILABLE or INUSE.
+func is_transient(err error) bool {
+	if errors.As(err, new(permanentError)) {
+		return false
+	}
+	if errors.As(err, new(connectionLostError)) {
+		return true
+	}
+
+	var rspError imap.ResponseError
+	if errors.As(err, &rspError) && rspError.Response != nil {
+		switch rspError.Label {
+		case "UNAVAILABLE", "INUSE":
+			return true
+		}
+		return rspError.Status == imap.BYE
+	}
+
+	var netError net.Error
+	return errors.As(err, &netError) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, imap.ErrTimeout) ||
+		errors.Is(err, imap.ErrAborted)
+}
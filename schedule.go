@@ -0,0 +1,221 @@
+package main
+
+// All stuff about scheduling runs of goifo's daemon.
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultInterval is used by daemon if neither interval nor cron is given in config file.
+const defaultInterval = 15 * time.Minute
+
+// iSchedule tells when daemon performs its next run.
+type iSchedule interface {
+	next(t time.Time) time.Time // time of the first run after t.  Zero if there is none.
+}
+
+// intervalSchedule_s runs daemon each time a fixed time span has elapsed.
+type intervalSchedule_s struct {
+	interval time.Duration
+}
+
+func (a intervalSchedule_s) next(t time.Time) time.Time {
+	return t.Add(a.interval)
+}
+
+// cronField_s describes a field of a cron expression.
+type cronField_s struct {
+	name string
+	min  int
+	max  int
+}
+
+// cronFields enumerates the fields of a cron expression in the order they are given.
+var cronFields = []cronField_s{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// cronMacros maps shorthands admitted as cron expressions to the expressions they stand for.
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// cronSchedule_s runs daemon at times matching a cron expression.
+// cf. [https://pubs.opengroup.org/onlinepubs/9699919799/utilities/crontab.html]
+type cronSchedule_s struct {
+	minute     uint64 // bit i is set if minute i matches.
+	hour       uint64
+	dayOfMonth uint64
+	month      uint64
+	dayOfWeek  uint64 // sunday is 0.
+	isDayOr    bool   // day of month and day of week are both restricted.  Either of them has to match.
+}
+
+// parse_cron parses a cron expression consisting of five fields minute, hour, day of month,
+// month and day of week.  Each field is a comma separated list of numbers, ranges a-b and *,
+// each optionally followed by a step /n.  7 is sunday, too.
+func parse_cron(expression string) (schedule cronSchedule_s, err error) {
+	if macro, isMacro := cronMacros[expression]; isMacro {
+		expression = macro
+	}
+
+	fields := strings.Fields(expression)
+	if len(fields) != len(cronFields) {
+		err = fmt.Errorf("cron expression %q: %d fields expected", expression, len(cronFields))
+		return
+	}
+
+	sets := make([]uint64, len(cronFields))
+	for i, field := range fields {
+		sets[i], err = parse_cron_field(field, cronFields[i])
+		if err != nil {
+			err = fmt.Errorf("cron expression %q: %w", expression, err)
+			return
+		}
+	}
+
+	schedule = cronSchedule_s{
+		minute:     sets[0],
+		hour:       sets[1],
+		dayOfMonth: sets[2],
+		month:      sets[3],
+		dayOfWeek:  sets[4],
+		isDayOr:    !strings.HasPrefix(fields[2], "*") && !strings.HasPrefix(fields[4], "*")}
+
+	// sunday may be given as 7, too.
+	if schedule.dayOfWeek&(1<<7) != 0 {
+		schedule.dayOfWeek |= 1
+	}
+
+	return
+}
+
+// parse_cron_field returns the set of values admitted by a field of a cron expression.
+func parse_cron_field(field string, kind cronField_s) (set uint64, err error) {
+	for _, item := range strings.Split(field, ",") {
+		rangeExpr, stepExpr, hasStep := strings.Cut(item, "/")
+
+		step := 1
+		if hasStep {
+			step, err = strconv.Atoi(stepExpr)
+			if err == nil && step <= 0 {
+				err = errors.New("step must be positive")
+			}
+			if err != nil {
+				err = fmt.Errorf("%s %s: %w", kind.name, item, err)
+				return
+			}
+		}
+
+		low, high := kind.min, kind.max
+		switch lowExpr, highExpr, isRange := strings.Cut(rangeExpr, "-"); {
+		case rangeExpr == "*":
+		case isRange:
+			low, err = parse_cron_value(lowExpr, kind)
+			if err == nil {
+				high, err = parse_cron_value(highExpr, kind)
+			}
+			if err == nil && low > high {
+				err = fmt.Errorf("%s %s: empty range", kind.name, item)
+			}
+		default:
+			low, err = parse_cron_value(rangeExpr, kind)
+			if !hasStep {
+				high = low
+			}
+		}
+		if err != nil {
+			return
+		}
+
+		for value := low; value <= high; value += step {
+			set |= 1 << value
+		}
+	}
+
+	return
+}
+
+// parse_cron_value parses a single number given in a field of a cron expression.
+func parse_cron_value(s string, kind cronField_s) (value int, err error) {
+	value, err = strconv.Atoi(s)
+	if err == nil && (value < kind.min || value > kind.max) {
+		err = fmt.Errorf("%d out of range %d-%d", value, kind.min, kind.max)
+	}
+	if err != nil {
+		err = fmt.Errorf("%s: %w", kind.name, err)
+	}
+
+	return
+}
+
+// matchesDay checks whether day of month and day of week of t match.
+func (a cronSchedule_s) matchesDay(t time.Time) bool {
+	isDayOfMonth := a.dayOfMonth&(1<<t.Day()) != 0
+	isDayOfWeek := a.dayOfWeek&(1<<t.Weekday()) != 0
+	if a.isDayOr {
+		return isDayOfMonth || isDayOfWeek
+	}
+	return isDayOfMonth && isDayOfWeek
+}
+
+// next returns the first minute after t matching the cron expression.
+// Matching minutes are looked for within the next five years only.
+func (a cronSchedule_s) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+
+	for t.Before(end) {
+		switch {
+		case a.month&(1<<t.Month()) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !a.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case a.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case a.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// new_schedule returns the schedule given by interval or cron in config file.
+func new_schedule(pConfigData *goifo_conf_s) (schedule iSchedule, err error) {
+	switch {
+	case pConfigData.Interval != 0 && pConfigData.Cron != "":
+		err = errors.New("either interval or cron admitted")
+	case pConfigData.Cron != "":
+		var cronSchedule cronSchedule_s
+		cronSchedule, err = parse_cron(pConfigData.Cron)
+		if err == nil && cronSchedule.next(time.Now()).IsZero() {
+			err = fmt.Errorf("cron expression %q never matches", pConfigData.Cron)
+		}
+		schedule = cronSchedule
+	case pConfigData.Interval < 0:
+		err = errors.New("interval must be positive")
+	case pConfigData.Interval > 0:
+		schedule = intervalSchedule_s{pConfigData.Interval}
+	default:
+		schedule = intervalSchedule_s{defaultInterval}
+	}
+
+	return
+}
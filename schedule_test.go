@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		want       string // equivalent expression.  Empty if an error is expected.
+	}{
+		{name: "macro", expression: "@daily", want: "0 0 * * *"},
+		{name: "sunday as 7", expression: "0 0 * * 7", want: "0 0 * * 0,7"},
+		{name: "step of range", expression: "0 0 * * 1-5/2", want: "0 0 * * 1,3,5"},
+		{name: "step of value", expression: "50/5 * * * *", want: "50,55 * * * *"},
+		{name: "step of star", expression: "*/20 * * * *", want: "0,20,40 * * * *"},
+		{name: "missing field", expression: "0 0 * *"},
+		{name: "out of range", expression: "60 * * * *"},
+		{name: "empty range", expression: "0 5-1 * * *"},
+		{name: "zero step", expression: "*/0 * * * *"},
+		{name: "no number", expression: "0 0 * * mon"},
+		{name: "unknown macro", expression: "@often"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parse_cron(test.expression)
+			if test.want == "" {
+				if err == nil {
+					t.Errorf("parse_cron(%q) = %+v, want error", test.expression, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := parse_cron(test.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("parse_cron(%q) = %+v, want %+v", test.expression, got, want)
+			}
+		})
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	// 2024-01-01 is a monday.
+	date := func(month time.Month, day int, hour int, minute int) time.Time {
+		return time.Date(2024, month, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name       string
+		expression string
+		t          time.Time
+		want       time.Time
+	}{
+		{"every quarter of an hour", "*/15 * * * *", date(1, 1, 10, 7), date(1, 1, 10, 15)},
+		{"strictly after t", "0 0 * * *", date(1, 1, 0, 0), date(1, 2, 0, 0)},
+		{"seconds are dropped", "* * * * *", date(1, 1, 10, 7).Add(30 * time.Second), date(1, 1, 10, 8)},
+		{"day of month only", "0 12 13 * *", date(1, 1, 0, 0), date(1, 13, 12, 0)},
+		{"day of week only", "0 12 * * 5", date(1, 1, 0, 0), date(1, 5, 12, 0)},
+		{"day of month or day of week", "0 12 13 * 5", date(1, 6, 0, 0), date(1, 12, 12, 0)},
+		{"day of week or day of month", "0 12 2 * 5", date(1, 1, 0, 0), date(1, 2, 12, 0)},
+		{"sunday as 7", "0 9 * * 7", date(1, 1, 0, 0), date(1, 7, 9, 0)},
+		{"step of weekdays", "0 9 * * 1-5/2", date(1, 1, 10, 0), date(1, 3, 9, 0)},
+		{"step of months", "0 0 1 */3 *", date(2, 10, 0, 0), date(4, 1, 0, 0)},
+		{"next year", "0 0 1 1 *", date(1, 1, 0, 0), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"leap day", "0 0 29 2 *", date(3, 1, 0, 0), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"never", "0 0 31 2 *", date(1, 1, 0, 0), time.Time{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule, err := parse_cron(test.expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := schedule.next(test.t); !got.Equal(test.want) {
+				t.Errorf("next(%s) = %s, want %s", test.t, got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewSchedule(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   goifo_conf_s
+		want     iSchedule // nil if an error is expected.
+		wantCron bool
+	}{
+		{name: "default", config: goifo_conf_s{}, want: intervalSchedule_s{defaultInterval}},
+		{name: "interval", config: goifo_conf_s{Interval: 5 * time.Minute}, want: intervalSchedule_s{5 * time.Minute}},
+		{name: "cron", config: goifo_conf_s{Cron: "@hourly"}, wantCron: true},
+		{name: "interval and cron", config: goifo_conf_s{Interval: 5 * time.Minute, Cron: "@hourly"}},
+		{name: "negative interval", config: goifo_conf_s{Interval: -time.Minute}},
+		{name: "broken cron", config: goifo_conf_s{Cron: "* * *"}},
+		{name: "cron never matching", config: goifo_conf_s{Cron: "0 0 30 2 *"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := new_schedule(&test.config)
+			switch {
+			case test.wantCron:
+				if _, isCron := got.(cronSchedule_s); err != nil || !isCron {
+					t.Errorf("new_schedule() = %+v, %v, want cron schedule", got, err)
+				}
+			case test.want == nil:
+				if err == nil {
+					t.Errorf("new_schedule() = %+v, want error", got)
+				}
+			case err != nil || got != test.want:
+				t.Errorf("new_schedule() = %+v, %v, want %+v", got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckCommandSchedule(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    goifo_conf_s
+		wantError bool
+	}{
+		{name: "cron", config: goifo_conf_s{Cron: "*/15 * * * *"}},
+		{name: "broken cron", config: goifo_conf_s{Cron: "61 * * * *"}, wantError: true},
+		{name: "negative interval", config: goifo_conf_s{Interval: -time.Minute}, wantError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := checkCommand(&test.config, &tls.Config{}); (err != nil) != test.wantError {
+				t.Errorf("checkCommand() error = %v, want error %v", err, test.wantError)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+// All stuff about remembering which emails of a mailbox were examined by former runs
+// so that incremental rules skip them.  If imap server supports CONDSTORE, emails not
+// changed since former runs are skipped by rules, too.
+// cf. [https://www.rfc-editor.org/rfc/rfc3501#section-2.3.1.1]
+// cf. [https://www.rfc-editor.org/rfc/rfc7162]
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/mxk/go-imap/imap"
+	"gopkg.in/yaml.v3"
+)
+
+// mailboxState_s describes the content of a file remembering the state of a mailbox.
+type mailboxState_s struct {
+	Host          string            `json:"host"`
+	Username      string            `json:"username"`
+	Mailbox       string            `json:"mailbox"`
+	UIDValidity   uint32            `json:"uidvalidity"`
+	LastUIDs      map[string]uint32 `json:"last_uids,omitempty"`     // highest UID of emails examined by each incremental rule given by its digest.
+	HighestModSeq uint64            `json:"highestmodseq,omitempty"` // HIGHESTMODSEQ reported on selecting mailbox.  0 if imap server does not support CONDSTORE.
+	Rules         []string          `json:"rules,omitempty"`         // digests of rules restricted to emails changed.
+}
+
+// mailboxStateFile names the file remembering the state of mailbox of username on host.
+func mailboxStateFile(host string, username string, mailbox string) string {
+	sum := sha256.Sum256([]byte(host + "\x00" + username + "\x00" + mailbox))
+	return filepath.Join(stateDir, "mailboxes", hex.EncodeToString(sum[:8])+".json")
+}
+
+// ruleDigest identifies a rule given in config file by its content.  It changes if the rule is edited.
+func ruleDigest(pRule *yaml.Node) string {
+	data, _ := yaml.Marshal(pRule)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// readMailboxState reads the state of a mailbox.  An empty state is returned if there is none.
+func readMailboxState(fileName string) (state mailboxState_s) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return
+	}
+
+	if json.Unmarshal(data, &state) != nil {
+		state = mailboxState_s{}
+	}
+
+	return
+}
+
+// writeMailboxState remembers the state of a mailbox.  The file is readable by its owner only.
+func writeMailboxState(fileName string, pState *mailboxState_s) (err error) {
+	err = os.MkdirAll(filepath.Dir(fileName), 0700)
+	if err != nil {
+		return
+	}
+
+	data, err := json.Marshal(pState)
+	if err != nil {
+		return
+	}
+
+	err = os.WriteFile(fileName, data, 0600)
+
+	return
+}
+
+// uidTracker_s tracks which emails of a mailbox selected are new to incremental rules
+// and which ones changed since rules succeeded on them.
+type uidTracker_s struct {
+	fileName     string
+	state        mailboxState_s    // to be remembered after all rules succeeded.
+	lastUIDs     map[string]uint32 // highest UID examined by incremental rules on former run.
+	changedSince uint64            // HIGHESTMODSEQ remembered.  0 if each email has to be considered.
+	rules        map[string]bool   // digests of rules succeeded on former run.
+	examined     map[string]bool   // digests of rules registered by examine.
+}
+
+// newUIDTracker compares the state remembered for mailbox with the status and HIGHESTMODSEQ
+// reported by imap server on selecting it.  If UIDVALIDITY changed, UIDs and MODSEQs remembered
+// are meaningless and rules consider each email.
+func newUIDTracker(host string, username string, mailbox string, pStatus *imap.MailboxStatus, highestModSeq uint64) (retval *uidTracker_s) {
+	retval = &uidTracker_s{
+		fileName: mailboxStateFile(host, username, mailbox),
+		lastUIDs: map[string]uint32{},
+		rules:    map[string]bool{},
+		examined: map[string]bool{}}
+	if pStatus == nil {
+		return
+	}
+
+	retval.state = mailboxState_s{
+		Host:          host,
+		Username:      username,
+		Mailbox:       mailbox,
+		UIDValidity:   pStatus.UIDValidity,
+		LastUIDs:      map[string]uint32{},
+		HighestModSeq: highestModSeq}
+
+	remembered := readMailboxState(retval.fileName)
+	switch {
+	case remembered.UIDValidity == 0:
+	case remembered.UIDValidity != pStatus.UIDValidity:
+		log.Printf("%s/%s: UIDVALIDITY changed.  incremental rules consider each email", host, mailbox)
+	default:
+		for digest, lastUID := range remembered.LastUIDs {
+			retval.lastUIDs[digest] = lastUID
+		}
+		if remembered.HighestModSeq == 0 || highestModSeq < remembered.HighestModSeq {
+			break
+		}
+		retval.changedSince = remembered.HighestModSeq
+		for _, digest := range remembered.Rules {
+			retval.rules[digest] = true
+		}
+		if retval.isUnchanged() {
+			log.Printf("%s/%s: unchanged since last run.  rules not depending on time are skipped", host, mailbox)
+		}
+	}
+
+	return
+}
+
+// isUnchanged tells whether no email of mailbox changed since former run.
+func (a *uidTracker_s) isUnchanged() bool {
+	return a.changedSince != 0 && a.changedSince == a.state.HighestModSeq
+}
+
+// nextUID returns the lowest UID the incremental rule given by digest has not examined on former run.
+// 1 if it has to consider each email.
+func (a *uidTracker_s) nextUID(digest string) uint32 {
+	return a.lastUIDs[digest] + 1
+}
+
+// searched remembers lastUID as the highest UID the incremental rule given by digest examined.
+func (a *uidTracker_s) searched(digest string, lastUID uint32) {
+	if a.state.LastUIDs != nil && lastUID > 0 {
+		a.state.LastUIDs[digest] = lastUID
+	}
+}
+
+// examine registers the rule given by digest as examining mailbox and returns the HIGHESTMODSEQ
+// remembered if that rule succeeded on former run.  0 if the rule has to consider each email.
+func (a *uidTracker_s) examine(digest string) (changedSince uint64) {
+	if a.state.HighestModSeq == 0 {
+		return
+	}
+
+	if !a.examined[digest] {
+		a.examined[digest] = true
+		a.state.Rules = append(a.state.Rules, digest)
+	}
+	if a.rules[digest] {
+		changedSince = a.changedSince
+	}
+
+	return
+}
+
+// commit remembers the emails examined by the rules registered.
+// Nothing is remembered if imap server did not report UIDVALIDITY.
+func (a *uidTracker_s) commit() (err error) {
+	if a.state.UIDValidity == 0 {
+		return
+	}
+
+	err = writeMailboxState(a.fileName, &a.state)
+
+	return
+}
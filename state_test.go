@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+func TestRestrictToNew(t *testing.T) {
+	tests := []struct {
+		name         string
+		remembered   map[string]uint32 // highest UIDs examined by rules on former run.
+		highestUID   string
+		wantCommands []string
+		wantLastUID  uint32 // 0 if nothing is remembered.
+	}{
+		{
+			name:         "first run",
+			highestUID:   "* SEARCH 150",
+			wantCommands: []string{"UID SEARCH CHARSET UTF-8 UID *", "UID SEARCH CHARSET UTF-8 UID 1:150"},
+			wantLastUID:  150},
+		{
+			name:         "emails arrived",
+			remembered:   map[string]uint32{"rule": 120, "other rule": 140},
+			highestUID:   "* SEARCH 150",
+			wantCommands: []string{"UID SEARCH CHARSET UTF-8 UID *", "UID SEARCH CHARSET UTF-8 UID 121:150"},
+			wantLastUID:  150},
+		{
+			name:         "other rule examined more emails",
+			remembered:   map[string]uint32{"rule": 100, "other rule": 150},
+			highestUID:   "* SEARCH 150",
+			wantCommands: []string{"UID SEARCH CHARSET UTF-8 UID *", "UID SEARCH CHARSET UTF-8 UID 101:150"},
+			wantLastUID:  150},
+		{
+			name:         "no email arrived",
+			remembered:   map[string]uint32{"rule": 150},
+			highestUID:   "* SEARCH 150",
+			wantCommands: []string{"UID SEARCH CHARSET UTF-8 UID *"},
+			wantLastUID:  150},
+		{
+			name:         "empty mailbox",
+			highestUID:   "* SEARCH",
+			wantCommands: []string{"UID SEARCH CHARSET UTF-8 UID *"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stateDir = t.TempDir()
+			fileName := mailboxStateFile("imap.example.org", "user", "INBOX")
+			if test.remembered != nil {
+				writeMailboxState(fileName, &mailboxState_s{UIDValidity: 1, LastUIDs: test.remembered})
+			}
+
+			pClient, commands := newTestClient(t, testReply_s{"UID SEARCH CHARSET UTF-8 UID *", []string{test.highestUID}})
+			processor := newRuleProcessor(pClient, nil, "INBOX", "")
+			processor.pTracker = newUIDTracker("imap.example.org", "user", "INBOX", pClient.Mailbox, 0)
+
+			if err := processor.restrictToNew("rule"); err != nil {
+				t.Fatal(err)
+			}
+			if err := processor.search(); err != nil {
+				t.Fatal(err)
+			}
+			if got := receivedCommands(commands); strings.Join(got, "\n") != strings.Join(test.wantCommands, "\n") {
+				t.Errorf("commands sent = %q, want %q", got, test.wantCommands)
+			}
+
+			if err := processor.pTracker.commit(); err != nil {
+				t.Fatal(err)
+			}
+			state := readMailboxState(fileName)
+			if got := state.LastUIDs["rule"]; got != test.wantLastUID {
+				t.Errorf("last UID remembered = %d, want %d", got, test.wantLastUID)
+			}
+			if _, isRemembered := state.LastUIDs["other rule"]; isRemembered {
+				t.Error("last UID of rule not examining mailbox any more is remembered")
+			}
+		})
+	}
+}
+
+func TestNewUIDTrackerUIDValidityChanged(t *testing.T) {
+	stateDir = t.TempDir()
+	writeMailboxState(
+		mailboxStateFile("imap.example.org", "user", "INBOX"),
+		&mailboxState_s{UIDValidity: 1, LastUIDs: map[string]uint32{"rule": 120}})
+
+	pTracker := newUIDTracker("imap.example.org", "user", "INBOX", &imap.MailboxStatus{UIDValidity: 2}, 0)
+	if got := pTracker.nextUID("rule"); got != 1 {
+		t.Errorf("nextUID() = %d, want 1", got)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+// All stuff about TLS settings of individual servers.
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// tlsVersions maps TLS versions admitted as tls_min_version to crypto/tls constants.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// server_tls_config returns a copy of pTLSConfig adjusted to the server described by pServer.
+func server_tls_config(pServer *server_s, pTLSConfig *tls.Config) (pServerTLSConfig *tls.Config, err error) {
+	pServerTLSConfig = pTLSConfig.Clone()
+
+	// client certificate for SASL EXTERNAL authentication.
+	// cf. [https://www.rfc-editor.org/rfc/rfc4422#appendix-A]
+	switch {
+	case pServer.ClientCert != "":
+		keyFile := pServer.ClientKey
+		if keyFile == "" {
+			keyFile = pServer.ClientCert
+		}
+		var certificate tls.Certificate
+		certificate, err = tls.LoadX509KeyPair(pServer.ClientCert, keyFile)
+		if err != nil {
+			err = fmt.Errorf("%s: client_cert: %w", pServer.Host, err)
+			return
+		}
+		pServerTLSConfig.Certificates = []tls.Certificate{certificate}
+	case pServer.ClientKey != "":
+		err = fmt.Errorf("%s: client_key requires client_cert", pServer.Host)
+		return
+	}
+
+	// ca certificates trusted for this server only.
+	switch {
+	case pServer.CAFile != "":
+		if pServer.CAFileOnly || pServerTLSConfig.RootCAs == nil {
+			pServerTLSConfig.RootCAs = x509.NewCertPool()
+		} else {
+			pServerTLSConfig.RootCAs = pServerTLSConfig.RootCAs.Clone()
+		}
+		err = add_ca_file(pServerTLSConfig.RootCAs, pServer.CAFile)
+		if err != nil {
+			err = fmt.Errorf("%s: ca_file: %w", pServer.Host, err)
+			return
+		}
+	case pServer.CAFileOnly:
+		err = fmt.Errorf("%s: ca_file_only requires ca_file", pServer.Host)
+		return
+	}
+
+	if pServer.TLSMinVersion != "" {
+		version, isAdmitted := tlsVersions[pServer.TLSMinVersion]
+		if !isAdmitted {
+			err = fmt.Errorf("%s: unknown tls_min_version %s.  admitted are 1.0, 1.1, 1.2 and 1.3", pServer.Host, pServer.TLSMinVersion)
+			return
+		}
+		pServerTLSConfig.MinVersion = version
+	}
+
+	// name used for SNI and for verifying server's certificate instead of host.
+	if pServer.ServerName != "" {
+		pServerTLSConfig.ServerName = pServer.ServerName
+	}
+
+	// for test servers only.  connect warns about it.
+	pServerTLSConfig.InsecureSkipVerify = pServer.TLSInsecureSkipVerify
+
+	if len(pServer.PinSHA256) > 0 {
+		var pins [][]byte
+		pins, err = decode_pins(pServer.PinSHA256)
+		if err != nil {
+			err = fmt.Errorf("%s: pin_sha256: %w", pServer.Host, err)
+			return
+		}
+		pServerTLSConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			return verify_pins(state, pins)
+		}
+	}
+
+	return
+}
+
+// decode_pins decodes base64 encoded SHA-256 hashes of SubjectPublicKeyInfo structures.
+func decode_pins(encodedPins []string) (pins [][]byte, err error) {
+	for _, encodedPin := range encodedPins {
+		pin, decodeError := base64.StdEncoding.DecodeString(encodedPin)
+		if decodeError == nil && len(pin) != sha256.Size {
+			decodeError = errors.New("no SHA-256 hash")
+		}
+		if decodeError != nil {
+			err = errors.Join(err, fmt.Errorf("%s: %w", encodedPin, decodeError))
+			continue
+		}
+		pins = append(pins, pin)
+	}
+
+	return
+}
+
+// verify_pins checks whether the public key of a certificate the server's certificate is
+// verified by matches one of pins.  If certificates are not verified at all only the
+// server's certificate itself is considered.
+// cf. [https://www.rfc-editor.org/rfc/rfc7469#section-2.4]
+func verify_pins(state tls.ConnectionState, pins [][]byte) error {
+	chains := state.VerifiedChains
+	if len(chains) == 0 && len(state.PeerCertificates) > 0 {
+		chains = [][]*x509.Certificate{state.PeerCertificates[:1]}
+	}
+
+	for _, chain := range chains {
+		for _, certificate := range chain {
+			hash := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if string(hash[:]) == string(pin) {
+					return nil
+				}
+			}
+		}
+	}
+
+	return errors.New("no public key of server's certificate chain matches pin_sha256")
+}
+
+// fetch_server_chain connects the server described by pServer and returns the certificate chain
+// presented during the TLS handshake.  The chain is returned even if it cannot be verified.
+// In this case verifyError tells why.  No authentication is performed.
+func fetch_server_chain(pServer *server_s, pTLSConfig *tls.Config) (chain []*x509.Certificate, verifyError error, err error) {
+	tlsMode, err := tls_mode(pServer)
+	if err != nil {
+		return
+	}
+	if tlsMode == "none" {
+		err = fmt.Errorf("%s: connection is not encrypted", pServer.Host)
+		return
+	}
+
+	pDialer, err := newDialer(pServer, tlsMode)
+	if err != nil {
+		return
+	}
+
+	pServerTLSConfig, err := server_tls_config(pServer, pTLSConfig)
+	if err != nil {
+		return
+	}
+
+	// verification is performed after the handshake so that invalid chains are seen, too.
+	pRecordingTLSConfig := pServerTLSConfig.Clone()
+	pRecordingTLSConfig.InsecureSkipVerify = true
+	pRecordingTLSConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		chain = state.PeerCertificates
+		return nil
+	}
+
+	conn, err := pDialer.dial(tlsMode, pRecordingTLSConfig)
+	if err != nil {
+		return
+	}
+
+	pClient, err := imap.NewClient(conn, pDialer.hostname, pDialer.greetingTimeout)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if tlsMode == "starttls" {
+		_, err = pClient.StartTLS(pRecordingTLSConfig)
+	}
+	pClient.Logout(logoutTimeout)
+	if err != nil {
+		return
+	}
+
+	verifyError = verify_chain(chain, pDialer.hostname, pServerTLSConfig)
+
+	return
+}
+
+// verify_chain verifies chain the way crypto/tls does during a handshake using pServerTLSConfig.
+func verify_chain(chain []*x509.Certificate, hostname string, pServerTLSConfig *tls.Config) (err error) {
+	if len(chain) == 0 {
+		err = errors.New("no certificate presented")
+		return
+	}
+
+	serverName := pServerTLSConfig.ServerName
+	if serverName == "" {
+		serverName = hostname
+	}
+	if ip := net.ParseIP(serverName); ip != nil {
+		serverName = ip.String()
+	}
+
+	if !pServerTLSConfig.InsecureSkipVerify {
+		pIntermediates := x509.NewCertPool()
+		for _, pCertificate := range chain[1:] {
+			pIntermediates.AddCert(pCertificate)
+		}
+		var verifiedChains [][]*x509.Certificate
+		verifiedChains, err = chain[0].Verify(x509.VerifyOptions{
+			Roots:         pServerTLSConfig.RootCAs,
+			Intermediates: pIntermediates,
+			DNSName:       serverName})
+		if err != nil {
+			return
+		}
+		if pServerTLSConfig.VerifyConnection != nil {
+			err = pServerTLSConfig.VerifyConnection(tls.ConnectionState{PeerCertificates: chain, VerifiedChains: verifiedChains})
+		}
+	} else if pServerTLSConfig.VerifyConnection != nil {
+		err = pServerTLSConfig.VerifyConnection(tls.ConnectionState{PeerCertificates: chain})
+	}
+
+	return
+}
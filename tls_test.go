@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"testing"
+)
+
+// testCertificate returns a certificate having spki as SubjectPublicKeyInfo and its pin.
+func testCertificate(spki string) (pCertificate *x509.Certificate, pin string) {
+	hash := sha256.Sum256([]byte(spki))
+	return &x509.Certificate{RawSubjectPublicKeyInfo: []byte(spki)}, base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func TestDecodePins(t *testing.T) {
+	_, pin := testCertificate("leaf")
+	shortPin := base64.StdEncoding.EncodeToString([]byte("too short"))
+
+	tests := []struct {
+		name      string
+		pins      []string
+		wantCount int
+		wantError bool
+	}{
+		{name: "pin", pins: []string{pin}, wantCount: 1},
+		{name: "no pin", pins: []string{}},
+		{name: "bad base64", pins: []string{"not base64!"}, wantError: true},
+		{name: "wrong length", pins: []string{shortPin}, wantError: true},
+		{name: "bad one among good ones", pins: []string{pin, shortPin, pin}, wantCount: 2, wantError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pins, err := decode_pins(test.pins)
+			if (err != nil) != test.wantError {
+				t.Errorf("decode_pins() error = %v, want error %v", err, test.wantError)
+			}
+			if len(pins) != test.wantCount {
+				t.Errorf("decode_pins() decoded %d pins, want %d", len(pins), test.wantCount)
+			}
+		})
+	}
+}
+
+func TestVerifyPins(t *testing.T) {
+	pLeaf, leafPin := testCertificate("leaf")
+	pIntermediate, intermediatePin := testCertificate("intermediate")
+	pRoot, rootPin := testCertificate("root")
+	_, otherPin := testCertificate("other")
+
+	verified := tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{pLeaf, pIntermediate},
+		VerifiedChains:   [][]*x509.Certificate{{pLeaf, pIntermediate, pRoot}}}
+	// tls_insecure_skip_verify leaves VerifiedChains empty.
+	unverified := tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{pLeaf, pIntermediate}}
+
+	tests := []struct {
+		name      string
+		state     tls.ConnectionState
+		pins      []string
+		wantError bool
+	}{
+		{name: "pin matches leaf", state: verified, pins: []string{leafPin}},
+		{name: "pin matches intermediate", state: verified, pins: []string{intermediatePin}},
+		{name: "pin matches root", state: verified, pins: []string{rootPin}},
+		{name: "one of several pins matches", state: verified, pins: []string{otherPin, intermediatePin}},
+		{name: "no pin matches", state: verified, pins: []string{otherPin}, wantError: true},
+		{name: "no pin", state: verified, pins: []string{}, wantError: true},
+		{name: "unverified pin matches leaf", state: unverified, pins: []string{leafPin}},
+		{name: "unverified pin matches intermediate only", state: unverified, pins: []string{intermediatePin}, wantError: true},
+		{name: "no certificate", state: tls.ConnectionState{}, pins: []string{leafPin}, wantError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pins, err := decode_pins(test.pins)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := verify_pins(test.state, pins); (err != nil) != test.wantError {
+				t.Errorf("verify_pins() error = %v, want error %v", err, test.wantError)
+			}
+		})
+	}
+}